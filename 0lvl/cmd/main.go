@@ -35,19 +35,25 @@ func main() {
 		log.Fatal().Err(err).Msg("")
 	}
 	defer repo.Close()
+
+	// Консьюмер стартует раньше endpoint, который отдает его метрики.
+	src, err := consumer.NewSource(cfg, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	cons, err := consumer.Run(src, repo, log, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	defer cons.Close()
 	
 	go func() {
-		err = endpoint.Run(ctx, repo, log)
+		err := endpoint.Run(ctx, repo, cons, log)
 		if err != nil {
 			log.Fatal().Err(err).Msg("")
 		}
 	}()
 
-	err = consumer.Run(repo, log, cfg)
-	if err != nil {
-		log.Fatal().Err(err).Msg("")
-	}
-
 	log.Info().Msg("[START SERVICE]")
 
 	signals := make(chan os.Signal, 16)
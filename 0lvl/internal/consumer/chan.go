@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+)
+
+// ChanSource — источник в памяти процесса для тестов Consumer.
+// Сообщения передаются через Send. Неподтвержденные сообщения
+// повторно не доставляются.
+type ChanSource struct {
+	msgs    chan *Message
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+
+	mu        sync.Mutex
+	seq       uint64
+	acked     []uint64
+	published []Message
+}
+
+// NewChanSource создает источник с очередью на size сообщений.
+func NewChanSource(size int) *ChanSource {
+	return &ChanSource{
+		msgs: make(chan *Message, size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Send ставит data в очередь и возвращает номер сообщения.
+// Блокируется, если очередь заполнена.
+func (s *ChanSource) Send(subject string, data []byte) uint64 {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	m := &Message{Subject: subject, Sequence: seq, Data: data, Timestamp: time.Now()}
+	m.ack = func() error {
+		s.mu.Lock()
+		s.acked = append(s.acked, seq)
+		s.mu.Unlock()
+		return nil
+	}
+	s.msgs <- m
+	return seq
+}
+
+// Acked возвращает номера подтвержденных сообщений в порядке подтверждения.
+func (s *ChanSource) Acked() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.acked...)
+}
+
+// Published возвращает сообщения, отправленные через Publish.
+func (s *ChanSource) Published() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.published...)
+}
+
+func (s *ChanSource) Start(handler func(*Message)) error {
+	s.started = true
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case m := <-s.msgs:
+				handler(m)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *ChanSource) Publish(subject string, data []byte) error {
+	s.mu.Lock()
+	s.published = append(s.published, Message{Subject: subject, Data: data, Timestamp: time.Now()})
+	s.mu.Unlock()
+	return nil
+}
+
+// Close останавливает доставку. Сообщения, оставшиеся в очереди, теряются.
+func (s *ChanSource) Close() error {
+	close(s.stop)
+	if s.started {
+		<-s.done
+	}
+	return nil
+}
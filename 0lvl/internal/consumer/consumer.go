@@ -1,31 +1,261 @@
 package consumer
 
 import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"0lvl/config"
 	"0lvl/internal/repository"
 
 	"github.com/rs/zerolog"
-	stan "github.com/nats-io/stan.go"
 )
 
 
-func Run(repo *repository.Repo, log zerolog.Logger, cfg config.Config) error {
-	sc, err := stan.Connect(cfg.StanClusterId, cfg.StanClientId); if err != nil {
-        return err
+// Store — хранилище ордеров консьюмера, реализуется *repository.Repo.
+type Store interface {
+	// SaveOrder сохраняет ордер из сообщения, см. repository.IsTransient.
+	SaveOrder(msg []byte) error
+
+	// SaveDeadLetter сохраняет сообщение, которое не удалось обработать.
+	SaveDeadLetter(d repository.DeadLetter) error
+}
+
+// Consumer читает ордера из Source и сохраняет их пулом воркеров.
+//
+// Сообщение подтверждается только после того, как ордер сохранен
+// или отправлен в dead letters, поэтому доставка остается at-least-once.
+// Порядок сохранения сообщений между воркерами не гарантируется.
+type Consumer struct {
+	src  Source
+	repo Store
+	log  zerolog.Logger
+	cfg  config.Config
+
+	// jobs передает сообщения из обработчика подписки воркерам, done останавливает воркеры.
+	jobs    chan *Message
+	done    chan struct{}
+	workers []workerStats
+	wg      sync.WaitGroup
+}
+
+// Stats — метрики консьюмера.
+type Stats struct {
+	MaxInflight int
+	Queued      int
+	Workers     []WorkerStats
+}
+
+// WorkerStats — метрики одного воркера.
+type WorkerStats struct {
+	Id int
+
+	// Processed — сохраненные ордера, DeadLettered — отправленные в dead letters,
+	// Failed — сообщения, которые не удалось ни сохранить, ни отправить в dead letters.
+	Processed    uint64
+	DeadLettered uint64
+	Failed       uint64
+
+	// Retries — повторы сохранения после временных ошибок.
+	Retries uint64
+
+	// BusyNanos — суммарное время обработки сообщений.
+	BusyNanos    uint64
+	LastSequence uint64
+}
+
+// workerStats — счетчики воркера, изменяются атомарно.
+type workerStats struct {
+	processed    uint64
+	deadLettered uint64
+	failed       uint64
+	retries      uint64
+	busyNanos    uint64
+	lastSequence uint64
+}
+
+// Run запускает cfg.ConsumerWorkers воркеров и доставку сообщений из src, см. NewSource.
+// Брокер держит неподтвержденными не больше cfg.StanMaxInflight сообщений.
+// Consumer владеет src и закрывает его в Close, в том числе при ошибке Run.
+func Run(src Source, repo Store, log zerolog.Logger, cfg config.Config) (*Consumer, error) {
+	if cfg.ConsumerWorkers <= 0 {
+		cfg.ConsumerWorkers = 1
+	}
+	cfg.StanMaxInflight = maxInflight(cfg)
+
+	c := &Consumer{
+		src: src,
+		repo: repo,
+		log: log,
+		cfg: cfg,
+		jobs: make(chan *Message, cfg.StanMaxInflight),
+		done: make(chan struct{}),
+		workers: make([]workerStats, cfg.ConsumerWorkers),
+	}
+	for i := range c.workers {
+		c.wg.Add(1)
+		go c.work(i)
+	}
+
+	// Обработчик только передает сообщение воркерам. Когда все воркеры заняты,
+	// он ждет, а брокер не шлет больше MaxInflight неподтвержденных сообщений.
+	handler := func(m *Message) {
+		select {
+		case c.jobs <- m:
+		case <-c.done:
+		}
+	}
+
+	err := src.Start(handler); if err != nil {
+		close(c.done)
+		c.wg.Wait()
+		src.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close дожидается сообщений, которые воркеры уже обрабатывают, и закрывает источник.
+// Сообщения из очереди воркеров не подтверждаются, брокер доставит их повторно.
+func (c *Consumer) Close() error {
+	close(c.done)
+	c.wg.Wait()
+	return c.src.Close()
+}
+
+// closing сообщает, что вызван Close.
+func (c *Consumer) closing() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
+}
 
-	handler := func(m *stan.Msg) {
-		err := repo.SaveOrder(m.Data); if err != nil {
-			log.Err(err).Msg("")
+// Stats возвращает текущие метрики консьюмера.
+func (c *Consumer) Stats() Stats {
+	s := Stats{
+		MaxInflight: c.cfg.StanMaxInflight,
+		Queued: len(c.jobs),
+		Workers: make([]WorkerStats, len(c.workers)),
+	}
+	for i := range c.workers {
+		w := &c.workers[i]
+		s.Workers[i] = WorkerStats{
+			Id: i,
+			Processed: atomic.LoadUint64(&w.processed),
+			DeadLettered: atomic.LoadUint64(&w.deadLettered),
+			Failed: atomic.LoadUint64(&w.failed),
+			Retries: atomic.LoadUint64(&w.retries),
+			BusyNanos: atomic.LoadUint64(&w.busyNanos),
+			LastSequence: atomic.LoadUint64(&w.lastSequence),
 		}
-	    //Даже если Repo вернул ошибку, помечается как обработанный
-        err = m.Ack(); if err != nil {
-			log.Err(err).Msg("")
+	}
+	return s
+}
+
+// Metric отдает метрики консьюмера в JSON.
+func (c *Consumer) Metric() []byte {
+	b, _ := json.Marshal(c.Stats())
+	return b
+}
+
+func (c *Consumer) work(id int) {
+	defer c.wg.Done()
+	w := &c.workers[id]
+	log := c.log.With().Int("worker", id).Logger()
+	for {
+		var m *Message
+		select {
+		case m = <-c.jobs:
+		case <-c.done:
+			return
 		}
+		start := time.Now()
+		c.handle(w, log, m)
+		atomic.AddUint64(&w.busyNanos, uint64(time.Since(start)))
+		atomic.StoreUint64(&w.lastSequence, m.Sequence)
 	}
+}
 
-	_, err = sc.Subscribe(cfg.StanSubject, handler, stan.SetManualAckMode(), stan.DurableName(cfg.StanClientId)); if err != nil {
+func (c *Consumer) handle(w *workerStats, log zerolog.Logger, m *Message) {
+	err := c.saveWithRetry(w, log, m)
+	if err != nil && repository.IsTransient(err) && c.closing() {
+		// Повторы прерваны остановкой: без подтверждения брокер доставит сообщение повторно.
+		log.Warn().Err(err).Uint64("sequence", m.Sequence).Msg("order save interrupted by shutdown")
+		return
+	}
+	if err != nil {
+		log.Err(err).Uint64("sequence", m.Sequence).Msg("order not saved")
+		err = c.deadLetter(log, m, err); if err != nil {
+			// Без подтверждения брокер доставит сообщение повторно.
+			atomic.AddUint64(&w.failed, 1)
+			log.Err(err).Uint64("sequence", m.Sequence).Msg("dead letter not saved")
+			return
+		}
+		atomic.AddUint64(&w.deadLettered, 1)
+	} else {
+		atomic.AddUint64(&w.processed, 1)
+	}
+    // Сообщение с ошибкой помечается как обработанное, когда оно уже лежит в dead letters.
+    err = m.Ack(); if err != nil {
+		log.Err(err).Msg("")
+	}
+}
+
+// saveWithRetry сохраняет ордер из m, повторяя попытку при временных ошибках
+// (см. repository.IsTransient) с экспоненциальной задержкой, пока не исчерпано
+// cfg.RetryMaxAttempts попыток. Возвращает последнюю ошибку.
+//
+// Пока идут повторы, сообщение не подтверждается и занимает воркер:
+// во время недоступности db очередь копится в брокере. Close прерывает ожидание повтора.
+func (c *Consumer) saveWithRetry(w *workerStats, log zerolog.Logger, m *Message) error {
+	backoff := c.cfg.RetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.repo.SaveOrder(m.Data)
+		if err == nil || !repository.IsTransient(err) || attempt >= c.cfg.RetryMaxAttempts {
+			return err
+		}
+
+		// Случайная добавка до половины задержки разводит повторы разных воркеров и экземпляров.
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		log.Warn().Err(err).Uint64("sequence", m.Sequence).Int("attempt", attempt).Dur("delay", delay).Msg("retry order save")
+		atomic.AddUint64(&w.retries, 1)
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return err
+		}
+
+		backoff *= 2
+		if backoff > c.cfg.RetryMaxBackoff {
+			backoff = c.cfg.RetryMaxBackoff
+		}
+	}
+}
+
+// deadLetter сохраняет сообщение m, которое не удалось обработать из-за cause,
+// в таблицу dead letters и, если задан StanDeadLetterSubject, публикует его туда.
+// Ошибка публикации только логируется: переотправка работает по таблице.
+func (c *Consumer) deadLetter(log zerolog.Logger, m *Message, cause error) error {
+	d := repository.DeadLetter{
+		Subject: m.Subject,
+		Sequence: m.Sequence,
+		Payload: m.Data,
+		Error: cause.Error(),
+		ReceivedAt: m.Timestamp,
+	}
+	err := c.repo.SaveDeadLetter(d); if err != nil {
 		return err
 	}
+	if c.cfg.StanDeadLetterSubject != "" {
+		b, _ := json.Marshal(d)
+		err = c.src.Publish(c.cfg.StanDeadLetterSubject, b); if err != nil {
+			log.Err(err).Str("subject", c.cfg.StanDeadLetterSubject).Msg("dead letter not published")
+		}
+	}
 	return nil
 }
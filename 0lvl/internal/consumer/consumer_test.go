@@ -0,0 +1,272 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"0lvl/config"
+	"0lvl/internal/repository"
+
+	"github.com/rs/zerolog"
+)
+
+// testStore — Store в памяти. save решает исход n-го вызова SaveOrder (с 1).
+type testStore struct {
+	save          func(n int, msg []byte) error
+	deadLetterErr error
+
+	mu          sync.Mutex
+	saves       int
+	deadLetters []repository.DeadLetter
+}
+
+func (s *testStore) SaveOrder(msg []byte) error {
+	s.mu.Lock()
+	s.saves++
+	n := s.saves
+	s.mu.Unlock()
+	if s.save == nil {
+		return nil
+	}
+	return s.save(n, msg)
+}
+
+func (s *testStore) SaveDeadLetter(d repository.DeadLetter) error {
+	if s.deadLetterErr != nil {
+		return s.deadLetterErr
+	}
+	s.mu.Lock()
+	s.deadLetters = append(s.deadLetters, d)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *testStore) Saves() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves
+}
+
+func (s *testStore) DeadLetters() []repository.DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]repository.DeadLetter(nil), s.deadLetters...)
+}
+
+func startConsumer(t *testing.T, store Store) (*Consumer, *ChanSource) {
+	t.Helper()
+	cfg := config.Config{
+		ConsumerWorkers: 2,
+		StanMaxInflight: 4,
+		StanDeadLetterSubject: "order-dead-letter",
+		RetryMaxAttempts: 3,
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff: 4 * time.Millisecond,
+	}
+	src := NewChanSource(cfg.StanMaxInflight)
+	c, err := Run(src, store, zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, src
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// totalStats суммирует метрики воркеров.
+func totalStats(c *Consumer) WorkerStats {
+	var total WorkerStats
+	for _, w := range c.Stats().Workers {
+		total.Processed += w.Processed
+		total.DeadLettered += w.DeadLettered
+		total.Failed += w.Failed
+		total.Retries += w.Retries
+	}
+	return total
+}
+
+// TestConsumerAckAfterSave проверяет, что сообщение подтверждается
+// только после сохранения ордера.
+func TestConsumerAckAfterSave(t *testing.T) {
+	saving := make(chan []byte, 1)
+	release := make(chan struct{})
+	store := &testStore{save: func(n int, msg []byte) error {
+		saving <- msg
+		<-release
+		return nil
+	}}
+	c, src := startConsumer(t, store)
+
+	seq := src.Send("order", []byte("order 1"))
+	if msg := <-saving; string(msg) != "order 1" {
+		t.Fatalf("saved %q; want %q", msg, "order 1")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if acked := src.Acked(); len(acked) != 0 {
+		t.Fatalf("acked %v before save finished", acked)
+	}
+	close(release)
+
+	waitFor(t, "ack", func() bool { return len(src.Acked()) == 1 })
+	if acked := src.Acked(); acked[0] != seq {
+		t.Fatalf("acked %v; want [%d]", acked, seq)
+	}
+	if s := totalStats(c); s.Processed != 1 || s.DeadLettered != 0 || s.Retries != 0 {
+		t.Fatalf("stats %+v; want 1 processed", s)
+	}
+}
+
+// TestConsumerRetry проверяет, что временная ошибка сохранения повторяется.
+func TestConsumerRetry(t *testing.T) {
+	store := &testStore{save: func(n int, msg []byte) error {
+		if n < 3 {
+			return fmt.Errorf("insert: %w", io.ErrUnexpectedEOF)
+		}
+		return nil
+	}}
+	c, src := startConsumer(t, store)
+
+	src.Send("order", []byte("order 1"))
+	waitFor(t, "ack", func() bool { return len(src.Acked()) == 1 })
+	if n := store.Saves(); n != 3 {
+		t.Fatalf("SaveOrder called %d times; want 3", n)
+	}
+	if s := totalStats(c); s.Processed != 1 || s.Retries != 2 || s.DeadLettered != 0 {
+		t.Fatalf("stats %+v; want 1 processed after 2 retries", s)
+	}
+	if dl := store.DeadLetters(); len(dl) != 0 {
+		t.Fatalf("dead letters %+v", dl)
+	}
+}
+
+// TestConsumerDeadLetter проверяет, что сообщение, которое не удалось сохранить,
+// подтверждается только после записи в dead letters.
+func TestConsumerDeadLetter(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		saves   int
+		retries uint64
+	}{
+		{name: "invalid order", err: fmt.Errorf("%w: bad json", repository.ErrInvalidOrder), saves: 1, retries: 0},
+		{name: "retries exhausted", err: io.ErrUnexpectedEOF, saves: 3, retries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &testStore{save: func(n int, msg []byte) error { return tt.err }}
+			c, src := startConsumer(t, store)
+
+			// Невалидный UTF-8 должен дойти до dead letter без замен.
+			const payload = "order \xff"
+			seq := src.Send("order", []byte(payload))
+			waitFor(t, "ack", func() bool { return len(src.Acked()) == 1 })
+			if n := store.Saves(); n != tt.saves {
+				t.Fatalf("SaveOrder called %d times; want %d", n, tt.saves)
+			}
+			if s := totalStats(c); s.DeadLettered != 1 || s.Processed != 0 || s.Retries != tt.retries {
+				t.Fatalf("stats %+v; want 1 dead lettered after %d retries", s, tt.retries)
+			}
+
+			dl := store.DeadLetters()
+			if len(dl) != 1 {
+				t.Fatalf("dead letters %+v; want 1", dl)
+			}
+			d := dl[0]
+			if d.Subject != "order" || d.Sequence != seq || string(d.Payload) != payload || d.Error != tt.err.Error() {
+				t.Fatalf("dead letter %+v", d)
+			}
+			published := src.Published()
+			if len(published) != 1 || published[0].Subject != "order-dead-letter" {
+				t.Fatalf("published %+v; want 1 message to order-dead-letter", published)
+			}
+			var pd repository.DeadLetter
+			if err := json.Unmarshal(published[0].Data, &pd); err != nil || string(pd.Payload) != payload {
+				t.Fatalf("published dead letter %s: %v", published[0].Data, err)
+			}
+		})
+	}
+}
+
+// TestConsumerDeadLetterFailed проверяет, что сообщение не подтверждается,
+// если его не удалось ни сохранить, ни записать в dead letters.
+func TestConsumerDeadLetterFailed(t *testing.T) {
+	store := &testStore{
+		save: func(n int, msg []byte) error { return errors.New("bad order") },
+		deadLetterErr: errors.New("db is down"),
+	}
+	c, src := startConsumer(t, store)
+
+	src.Send("order", []byte("order 1"))
+	waitFor(t, "failure", func() bool { return totalStats(c).Failed == 1 })
+	if acked := src.Acked(); len(acked) != 0 {
+		t.Fatalf("acked %v after dead letter failed", acked)
+	}
+	if published := src.Published(); len(published) != 0 {
+		t.Fatalf("published %+v after dead letter failed", published)
+	}
+}
+
+// TestConsumerConfig проверяет, что общие настройки источника
+// берутся из STAN_*, если не заданы.
+func TestConsumerConfig(t *testing.T) {
+	cfg := config.Config{StanSubject: "order", StanClientId: "client-3", StanAckWait: time.Minute}
+	if s, g, w := consumerSubject(cfg), consumerGroup(cfg), consumerAckWait(cfg); s != "order" || g != "client-3" || w != time.Minute {
+		t.Fatalf("fallback config: %q %q %s", s, g, w)
+	}
+	cfg.ConsumerSubject, cfg.ConsumerGroup, cfg.ConsumerAckWait = "orders", "orders-group", time.Second
+	if s, g, w := consumerSubject(cfg), consumerGroup(cfg), consumerAckWait(cfg); s != "orders" || g != "orders-group" || w != time.Second {
+		t.Fatalf("consumer config: %q %q %s", s, g, w)
+	}
+}
+
+// TestConsumerCloseDuringRetry проверяет, что Close прерывает ожидание
+// повтора, а сообщение остается неподтвержденным и не попадает в dead letters.
+func TestConsumerCloseDuringRetry(t *testing.T) {
+	store := &testStore{save: func(n int, msg []byte) error { return io.ErrUnexpectedEOF }}
+	cfg := config.Config{
+		ConsumerWorkers: 1,
+		StanMaxInflight: 1,
+		RetryMaxAttempts: 3,
+		RetryInitialBackoff: time.Hour,
+		RetryMaxBackoff: time.Hour,
+	}
+	src := NewChanSource(cfg.StanMaxInflight)
+	c, err := Run(src, store, zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	src.Send("order", []byte("order 1"))
+	waitFor(t, "retry", func() bool { return totalStats(c).Retries == 1 })
+	closed := make(chan error)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close blocked by retry backoff")
+	}
+	if acked := src.Acked(); len(acked) != 0 {
+		t.Fatalf("acked %v after interrupted retry", acked)
+	}
+	if dl := store.DeadLetters(); len(dl) != 0 {
+		t.Fatalf("dead letters %+v after interrupted retry", dl)
+	}
+	if s := totalStats(c); s.Processed != 0 || s.DeadLettered != 0 || s.Failed != 0 {
+		t.Fatalf("stats %+v after interrupted retry", s)
+	}
+}
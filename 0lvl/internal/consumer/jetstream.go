@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"0lvl/config"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// JetStreamSource читает ордера из durable pull-консьюмера NATS JetStream.
+type JetStreamSource struct {
+	nc  *nats.Conn
+	js  nats.JetStreamContext
+	log zerolog.Logger
+	cfg config.Config
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewJetStreamSource(cfg config.Config, log zerolog.Logger) (*JetStreamSource, error) {
+	nc, err := nats.Connect(cfg.NatsUrl, nats.Name(consumerGroup(cfg))); if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream(); if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &JetStreamSource{nc: nc, js: js, log: log, cfg: cfg}, nil
+}
+
+// Start подписывается на consumerSubject durable-консьюмером consumerGroup.
+// Если задан cfg.JetStreamStream, подписка привязывается к этому стриму,
+// а при его отсутствии стрим создается.
+func (s *JetStreamSource) Start(handler func(*Message)) error {
+	opts := []nats.SubOpt{nats.AckWait(consumerAckWait(s.cfg)), nats.MaxAckPending(maxInflight(s.cfg))}
+	if s.cfg.JetStreamStream != "" {
+		err := s.ensureStream(); if err != nil {
+			return err
+		}
+		opts = append(opts, nats.BindStream(s.cfg.JetStreamStream))
+	}
+	sub, err := s.js.PullSubscribe(consumerSubject(s.cfg), consumerGroup(s.cfg), opts...); if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.fetch(ctx, sub, handler)
+	return nil
+}
+
+func (s *JetStreamSource) ensureStream() error {
+	_, err := s.js.StreamInfo(s.cfg.JetStreamStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = s.js.AddStream(&nats.StreamConfig{
+			Name: s.cfg.JetStreamStream,
+			Subjects: []string{consumerSubject(s.cfg)},
+		})
+	}
+	return err
+}
+
+// fetch забирает сообщения пачками по числу воркеров, пока ctx не отменен.
+func (s *JetStreamSource) fetch(ctx context.Context, sub *nats.Subscription, handler func(*Message)) {
+	defer close(s.done)
+	batch := s.cfg.ConsumerWorkers
+	if batch <= 0 {
+		batch = 1
+	}
+	for {
+		msgs, err := sub.Fetch(batch, nats.Context(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			s.log.Err(err).Str("subject", consumerSubject(s.cfg)).Msg("jetstream fetch failed")
+			select {
+			case <-time.After(fetchErrorDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		for _, m := range msgs {
+			handler(newJetStreamMessage(m))
+		}
+	}
+}
+
+func newJetStreamMessage(m *nats.Msg) *Message {
+	msg := &Message{
+		Subject: m.Subject,
+		Data: m.Data,
+		ack: func() error { return m.Ack() },
+	}
+	meta, err := m.Metadata(); if err == nil {
+		msg.Sequence = meta.Sequence.Stream
+		msg.Timestamp = meta.Timestamp
+	}
+	return msg
+}
+
+// Publish отправляет сообщение обычным NATS: его сохранит стрим,
+// в который входит subject, если такой есть.
+func (s *JetStreamSource) Publish(subject string, data []byte) error {
+	return s.nc.Publish(subject, data)
+}
+
+// Close останавливает Fetch и закрывает соединение. Подписка не отписывается,
+// иначе nats.go удалит durable-консьюмер вместе с позицией чтения.
+func (s *JetStreamSource) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	s.nc.Close()
+	return nil
+}
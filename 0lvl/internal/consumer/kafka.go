@@ -0,0 +1,219 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrPartitionRevoked возвращается Ack, если после ребалансировки партицию
+// сообщения начали читать заново. Сообщение будет доставлено повторно.
+var ErrPartitionRevoked = errors.New("kafka partition revoked")
+
+// KafkaRecord — запись топика Kafka.
+type KafkaRecord struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Time      time.Time
+}
+
+// KafkaGroup — участник consumer group Kafka с ручным коммитом offset.
+// Реализуется KafkaReaderGroup, в тестах — fakeKafka.
+type KafkaGroup interface {
+	// Fetch блокируется до следующей записи назначенных партиций или отмены ctx.
+	// После ребалансировки партиция читается с закоммиченного offset.
+	Fetch(ctx context.Context) (KafkaRecord, error)
+
+	// Commit фиксирует, что r и все предыдущие записи партиции обработаны:
+	// группа продолжит чтение с r.Offset+1.
+	Commit(ctx context.Context, r KafkaRecord) error
+
+	// Produce пишет value в topic.
+	Produce(ctx context.Context, topic string, value []byte) error
+
+	Close() error
+}
+
+// KafkaSource читает ордера из consumer group Kafka.
+//
+// Воркеры подтверждают сообщения в произвольном порядке, а Kafka хранит
+// один offset на партицию, поэтому коммитится только offset, до которого
+// подтверждены все сообщения партиции. После перезапуска или ребалансировки
+// неподтвержденные сообщения и часть подтвержденных за ними доставляются повторно.
+type KafkaSource struct {
+	group KafkaGroup
+	log   zerolog.Logger
+
+	mu         sync.Mutex
+	partitions map[kafkaPartition]*offsetTracker
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+// offsetTracker — записи партиции, выданные воркерам, в порядке offset.
+// revoked — партицию начали читать заново, трекер больше не коммитит.
+// ready — последняя запись, до которой подтверждено все, committed — ее
+// offset, уже закоммиченный в группу. Коммиты идут под commitMu без mu,
+// чтобы медленный брокер не блокировал подтверждения и чтение партиции.
+type offsetTracker struct {
+	mu        sync.Mutex
+	inflight  []KafkaRecord
+	acked     map[int64]bool
+	last      int64
+	revoked   bool
+	ready     KafkaRecord
+	committed int64
+
+	commitMu sync.Mutex
+}
+
+func NewKafkaSource(group KafkaGroup, log zerolog.Logger) *KafkaSource {
+	return &KafkaSource{
+		group: group,
+		log: log,
+		partitions: make(map[kafkaPartition]*offsetTracker),
+	}
+}
+
+func (s *KafkaSource) Start(handler func(*Message)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.fetch(ctx, handler)
+	return nil
+}
+
+func (s *KafkaSource) fetch(ctx context.Context, handler func(*Message)) {
+	defer close(s.done)
+	for {
+		r, err := s.group.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Err(err).Msg("kafka fetch failed")
+			select {
+			case <-time.After(fetchErrorDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		handler(s.message(r))
+	}
+}
+
+// message ставит r в очередь коммита его партиции.
+func (s *KafkaSource) message(r KafkaRecord) *Message {
+	p := kafkaPartition{topic: r.Topic, partition: r.Partition}
+	s.mu.Lock()
+	t := s.partitions[p]
+	// Подтверждения записей отозванного трекера больше не в счет.
+	if t != nil && t.revoke(r.Offset) {
+		t = nil
+	}
+	if t == nil {
+		t = &offsetTracker{acked: make(map[int64]bool), committed: -1}
+		s.partitions[p] = t
+	}
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	t.inflight = append(t.inflight, KafkaRecord{Topic: r.Topic, Partition: r.Partition, Offset: r.Offset})
+	t.last = r.Offset
+	t.mu.Unlock()
+
+	return &Message{
+		Subject: r.Topic,
+		Sequence: uint64(r.Offset),
+		Data: r.Value,
+		Timestamp: r.Time,
+		ack: func() error { return s.ack(t, r.Offset) },
+	}
+}
+
+func (s *KafkaSource) ack(t *offsetTracker, offset int64) error {
+	t.mu.Lock()
+	if t.revoked {
+		t.mu.Unlock()
+		return ErrPartitionRevoked
+	}
+	t.acked[offset] = true
+	n := 0
+	for n < len(t.inflight) && t.acked[t.inflight[n].Offset] {
+		delete(t.acked, t.inflight[n].Offset)
+		n++
+	}
+	if n > 0 {
+		t.ready = t.inflight[n-1]
+		t.inflight = append(t.inflight[:0], t.inflight[n:]...)
+	}
+	t.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	return s.commit(t)
+}
+
+// commit коммитит t.ready, если его offset больше закоммиченного.
+// Коммиты трекера идут по одному, поэтому offset партиции не откатывается,
+// а подтверждения, накопившиеся за время коммита, уходят одним коммитом.
+func (s *KafkaSource) commit(t *offsetTracker) error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	t.mu.Lock()
+	r, revoked := t.ready, t.revoked
+	t.mu.Unlock()
+	if revoked {
+		return ErrPartitionRevoked
+	}
+	if r.Offset <= t.committed {
+		return nil
+	}
+	err := s.group.Commit(context.Background(), r); if err != nil {
+		return err
+	}
+	t.committed = r.Offset
+	return nil
+}
+
+// revoke отзывает трекер, если offset не больше уже выданного: партицию
+// перечитывают с закоммиченного offset после ребалансировки.
+// Текущий коммит трекера дожидается, чтобы он не пришел после коммитов нового.
+func (t *offsetTracker) revoke(offset int64) bool {
+	t.mu.Lock()
+	if offset > t.last {
+		t.mu.Unlock()
+		return false
+	}
+	t.revoked = true
+	t.mu.Unlock()
+	t.commitMu.Lock()
+	t.commitMu.Unlock()
+	return true
+}
+
+func (s *KafkaSource) Publish(subject string, data []byte) error {
+	return s.group.Produce(context.Background(), subject, data)
+}
+
+// Close останавливает Fetch и выходит из группы.
+func (s *KafkaSource) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	return s.group.Close()
+}
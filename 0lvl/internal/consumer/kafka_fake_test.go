@@ -0,0 +1,247 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errKafkaMemberClosed возвращается методами закрытого участника fakeKafka.
+var errKafkaMemberClosed = errors.New("kafka group member closed")
+
+// fakeKafka — брокер Kafka в памяти процесса для тестов KafkaSource.
+//
+// Поддерживает топики с партициями, consumer group с коммитом offset
+// и ребалансировку: при входе и выходе участника партиции топика
+// распределяются между участниками группы заново, и каждая партиция
+// читается с закоммиченного offset.
+type fakeKafka struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string][][]KafkaRecord
+	committed  map[fakeOffsetKey]int64
+	groups     map[fakeGroupKey][]*fakeKafkaMember
+	produced   uint64
+
+	// changed закрывается и пересоздается при любом изменении, будит Fetch.
+	changed chan struct{}
+}
+
+type fakeGroupKey struct {
+	group string
+	topic string
+}
+
+type fakeOffsetKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// fakeKafkaMember — участник consumer group fakeKafka, реализует KafkaGroup.
+type fakeKafkaMember struct {
+	k     *fakeKafka
+	key   fakeGroupKey
+	next  map[int32]int64
+	order []int32
+	rr    int
+
+	closed bool
+}
+
+// newFakeKafka создает брокер, в котором у каждого топика partitions партиций.
+func newFakeKafka(partitions int) *fakeKafka {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	return &fakeKafka{
+		partitions: partitions,
+		topics: make(map[string][][]KafkaRecord),
+		committed: make(map[fakeOffsetKey]int64),
+		groups: make(map[fakeGroupKey][]*fakeKafkaMember),
+		changed: make(chan struct{}),
+	}
+}
+
+// Produce пишет запись в партицию, выбранную по key.
+// Записи без key распределяются по партициям по очереди.
+func (k *fakeKafka) Produce(topic string, key, value []byte) (int32, int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var p int32
+	if key != nil {
+		h := fnv.New32a()
+		h.Write(key)
+		p = int32(h.Sum32() % uint32(k.partitions))
+	} else {
+		p = int32(k.produced % uint64(k.partitions))
+	}
+	k.produced++
+
+	parts := k.topic(topic)
+	r := KafkaRecord{
+		Topic: topic,
+		Partition: p,
+		Offset: int64(len(parts[p])),
+		Key: key,
+		Value: value,
+		Time: time.Now(),
+	}
+	parts[p] = append(parts[p], r)
+	k.notifyLocked()
+	return p, r.Offset
+}
+
+// Records возвращает записи топика по партициям в порядке offset.
+func (k *fakeKafka) Records(topic string) []KafkaRecord {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var rs []KafkaRecord
+	for _, part := range k.topics[topic] {
+		rs = append(rs, part...)
+	}
+	return rs
+}
+
+// Committed возвращает offset, с которого группа продолжит читать партицию.
+func (k *fakeKafka) Committed(group, topic string, partition int32) int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.committed[fakeOffsetKey{group: group, topic: topic, partition: partition}]
+}
+
+// Join добавляет участника в группу group, читающую topic.
+func (k *fakeKafka) Join(group, topic string) *fakeKafkaMember {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	m := &fakeKafkaMember{k: k, key: fakeGroupKey{group: group, topic: topic}}
+	k.topic(topic)
+	k.groups[m.key] = append(k.groups[m.key], m)
+	k.rebalanceLocked(m.key)
+	return m
+}
+
+func (k *fakeKafka) topic(topic string) [][]KafkaRecord {
+	parts, ok := k.topics[topic]
+	if !ok {
+		parts = make([][]KafkaRecord, k.partitions)
+		k.topics[topic] = parts
+	}
+	return parts
+}
+
+// rebalanceLocked раздает партиции участникам группы по кругу
+// и возвращает их позиции к закоммиченным offset.
+func (k *fakeKafka) rebalanceLocked(key fakeGroupKey) {
+	members := k.groups[key]
+	for _, m := range members {
+		m.next = make(map[int32]int64)
+		m.order = m.order[:0]
+		m.rr = 0
+	}
+	if len(members) == 0 {
+		return
+	}
+	for p := int32(0); p < int32(k.partitions); p++ {
+		m := members[int(p)%len(members)]
+		m.next[p] = k.committed[fakeOffsetKey{group: key.group, topic: key.topic, partition: p}]
+		m.order = append(m.order, p)
+	}
+	k.notifyLocked()
+}
+
+func (k *fakeKafka) notifyLocked() {
+	close(k.changed)
+	k.changed = make(chan struct{})
+}
+
+// Partitions возвращает партиции, назначенные участнику.
+func (m *fakeKafkaMember) Partitions() []int32 {
+	m.k.mu.Lock()
+	defer m.k.mu.Unlock()
+	ps := append([]int32(nil), m.order...)
+	sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+	return ps
+}
+
+func (m *fakeKafkaMember) Fetch(ctx context.Context) (KafkaRecord, error) {
+	k := m.k
+	for {
+		k.mu.Lock()
+		if m.closed {
+			k.mu.Unlock()
+			return KafkaRecord{}, errKafkaMemberClosed
+		}
+		parts := k.topics[m.key.topic]
+		for i := 0; i < len(m.order); i++ {
+			p := m.order[(m.rr+i)%len(m.order)]
+			next := m.next[p]
+			if next < int64(len(parts[p])) {
+				m.next[p] = next + 1
+				m.rr = (m.rr + i + 1) % len(m.order)
+				r := parts[p][next]
+				k.mu.Unlock()
+				return r, nil
+			}
+		}
+		changed := k.changed
+		k.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return KafkaRecord{}, ctx.Err()
+		}
+	}
+}
+
+// Commit отклоняет коммит партиции, которая не назначена участнику,
+// как Kafka отклоняет коммит из прошлого поколения группы.
+func (m *fakeKafkaMember) Commit(ctx context.Context, r KafkaRecord) error {
+	k := m.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if m.closed {
+		return errKafkaMemberClosed
+	}
+	if r.Topic != m.key.topic {
+		return fmt.Errorf("kafka commit of topic %q by member of %q", r.Topic, m.key.topic)
+	}
+	_, ok := m.next[r.Partition]
+	if !ok {
+		return fmt.Errorf("kafka commit of partition %d not assigned to member", r.Partition)
+	}
+	k.committed[fakeOffsetKey{group: m.key.group, topic: r.Topic, partition: r.Partition}] = r.Offset + 1
+	return nil
+}
+
+func (m *fakeKafkaMember) Produce(ctx context.Context, topic string, value []byte) error {
+	m.k.Produce(topic, nil, value)
+	return nil
+}
+
+// Close выводит участника из группы, его партиции достаются остальным.
+func (m *fakeKafkaMember) Close() error {
+	k := m.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	members := k.groups[m.key]
+	for i, other := range members {
+		if other == m {
+			k.groups[m.key] = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	k.rebalanceLocked(m.key)
+	k.notifyLocked()
+	return nil
+}
@@ -0,0 +1,218 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func startKafkaSource(t *testing.T, m *fakeKafkaMember) (*KafkaSource, chan *Message) {
+	t.Helper()
+	msgs := make(chan *Message, 100)
+	s := NewKafkaSource(m, zerolog.Nop())
+	if err := s.Start(func(msg *Message) { msgs <- msg }); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, msgs
+}
+
+func recvMessages(t *testing.T, msgs chan *Message, n int) []*Message {
+	t.Helper()
+	got := make([]*Message, 0, n)
+	for len(got) < n {
+		select {
+		case m := <-msgs:
+			got = append(got, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", len(got), n)
+		}
+	}
+	return got
+}
+
+// TestKafkaSourceCommit проверяет, что при подтверждении не по порядку
+// коммитится только offset, до которого подтверждено все.
+func TestKafkaSourceCommit(t *testing.T) {
+	k := newFakeKafka(1)
+	for i := 0; i < 5; i++ {
+		k.Produce("order", nil, []byte(fmt.Sprintf("order %d", i)))
+	}
+	_, msgs := startKafkaSource(t, k.Join("g", "order"))
+	got := recvMessages(t, msgs, 5)
+	for i, m := range got {
+		if m.Sequence != uint64(i) || string(m.Data) != fmt.Sprintf("order %d", i) {
+			t.Fatalf("message %d: sequence %d, data %q", i, m.Sequence, m.Data)
+		}
+	}
+
+	steps := []struct {
+		ack       int
+		committed int64
+	}{
+		{ack: 1, committed: 0},
+		{ack: 2, committed: 0},
+		{ack: 0, committed: 3},
+		{ack: 4, committed: 3},
+		{ack: 3, committed: 5},
+	}
+	for _, step := range steps {
+		if err := got[step.ack].Ack(); err != nil {
+			t.Fatalf("Ack(%d): %s", step.ack, err)
+		}
+		if c := k.Committed("g", "order", 0); c != step.committed {
+			t.Fatalf("after Ack(%d) committed %d, want %d", step.ack, c, step.committed)
+		}
+	}
+}
+
+// TestKafkaSourceRedelivery проверяет, что новый участник группы
+// получает сообщения, не подтвержденные предыдущим.
+func TestKafkaSourceRedelivery(t *testing.T) {
+	k := newFakeKafka(2)
+	for i := 0; i < 10; i++ {
+		k.Produce("order", nil, []byte(fmt.Sprintf("order %d", i)))
+	}
+
+	s, msgs := startKafkaSource(t, k.Join("g", "order"))
+	acked := make(map[string]bool)
+	for i, m := range recvMessages(t, msgs, 10) {
+		if i%3 == 0 {
+			continue
+		}
+		if err := m.Ack(); err != nil {
+			t.Fatalf("Ack: %s", err)
+		}
+		acked[string(m.Data)] = true
+	}
+	s.Close()
+
+	// Вместе с неподтвержденными повторно приходят и подтвержденные после них.
+	unacked := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf("order %d", i)
+		if !acked[data] {
+			unacked[data] = true
+		}
+	}
+	_, msgs = startKafkaSource(t, k.Join("g", "order"))
+	for len(unacked) > 0 {
+		select {
+		case m := <-msgs:
+			delete(unacked, string(m.Data))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not redelivered: %v", unacked)
+		}
+	}
+}
+
+// TestKafkaSourceRebalance проверяет, что подтверждение сообщения из партиции,
+// которую после ребалансировки читают заново, не коммитит offset.
+func TestKafkaSourceRebalance(t *testing.T) {
+	k := newFakeKafka(2)
+	k.Produce("order", []byte("a"), []byte("order a"))
+
+	_, msgs := startKafkaSource(t, k.Join("g", "order"))
+	first := recvMessages(t, msgs, 1)[0]
+
+	// Второй участник входит и выходит, партиции возвращаются первому с offset 0.
+	other := k.Join("g", "order")
+	other.Close()
+
+	again := recvMessages(t, msgs, 1)[0]
+	if again.Sequence != first.Sequence || string(again.Data) != "order a" {
+		t.Fatalf("redelivered %q at %d, want %q at %d", again.Data, again.Sequence, first.Data, first.Sequence)
+	}
+	if err := first.Ack(); !errors.Is(err, ErrPartitionRevoked) {
+		t.Fatalf("Ack of revoked message: %v, want ErrPartitionRevoked", err)
+	}
+	p, _ := k.Produce("order", []byte("a"), []byte("order a2"))
+	if c := k.Committed("g", "order", p); c != 0 {
+		t.Fatalf("committed %d after revoked ack", c)
+	}
+	if err := again.Ack(); err != nil {
+		t.Fatalf("Ack: %s", err)
+	}
+	if c := k.Committed("g", "order", p); c != 1 {
+		t.Fatalf("committed %d, want 1", c)
+	}
+}
+
+// slowCommitMember — участник группы, Commit которого ждет release.
+type slowCommitMember struct {
+	*fakeKafkaMember
+	commits chan KafkaRecord
+	release chan struct{}
+}
+
+func (m *slowCommitMember) Commit(ctx context.Context, r KafkaRecord) error {
+	m.commits <- r
+	<-m.release
+	return m.fakeKafkaMember.Commit(ctx, r)
+}
+
+// TestKafkaSourceSlowCommit проверяет, что медленный коммит не блокирует
+// чтение и подтверждения партиции и offset не откатывается.
+func TestKafkaSourceSlowCommit(t *testing.T) {
+	k := newFakeKafka(1)
+	for i := 0; i < 3; i++ {
+		k.Produce("order", nil, []byte(fmt.Sprintf("order %d", i)))
+	}
+	m := &slowCommitMember{
+		fakeKafkaMember: k.Join("g", "order"),
+		commits: make(chan KafkaRecord, 10),
+		release: make(chan struct{}),
+	}
+	msgs := make(chan *Message, 100)
+	s := NewKafkaSource(m, zerolog.Nop())
+	if err := s.Start(func(msg *Message) { msgs <- msg }); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer s.Close()
+	got := recvMessages(t, msgs, 3)
+
+	errs := make(chan error, 3)
+	go func() { errs <- got[0].Ack() }()
+	if r := <-m.commits; r.Offset != 0 {
+		t.Fatalf("first commit of offset %d, want 0", r.Offset)
+	}
+	go func() { errs <- got[2].Ack() }()
+	go func() { errs <- got[1].Ack() }()
+	// Пока коммит висит, партиция читается дальше.
+	k.Produce("order", nil, []byte("order 3"))
+	recvMessages(t, msgs, 1)
+
+	close(m.release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Ack: %s", err)
+		}
+	}
+	last := int64(0)
+	for len(m.commits) > 0 {
+		r := <-m.commits
+		if r.Offset <= last {
+			t.Fatalf("commit of offset %d after %d", r.Offset, last)
+		}
+		last = r.Offset
+	}
+	if c := k.Committed("g", "order", 0); c != 3 {
+		t.Fatalf("committed %d, want 3", c)
+	}
+}
+
+func TestKafkaSourcePublish(t *testing.T) {
+	k := newFakeKafka(1)
+	s, _ := startKafkaSource(t, k.Join("g", "order"))
+	if err := s.Publish("order-dead-letter", []byte("bad order")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+	rs := k.Records("order-dead-letter")
+	if len(rs) != 1 || string(rs[0].Value) != "bad order" {
+		t.Fatalf("dead letter topic: %+v", rs)
+	}
+}
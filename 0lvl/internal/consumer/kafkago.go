@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"0lvl/config"
+
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaReaderGroup — KafkaGroup поверх клиента kafka-go:
+// kafka.Reader в consumer group с синхронным коммитом offset
+// и kafka.Writer для dead letters.
+type KafkaReaderGroup struct {
+	reader *kafka.Reader
+	writer *kafka.Writer
+}
+
+// NewKafkaReaderGroup подключается к cfg.KafkaBrokers участником группы
+// consumerGroup, читающей топик consumerSubject.
+// Новая группа читает топик с начала.
+func NewKafkaReaderGroup(cfg config.Config, log zerolog.Logger) *KafkaReaderGroup {
+	errorLog := kafka.LoggerFunc(func(msg string, args ...interface{}) {
+		log.Error().Msgf(msg, args...)
+	})
+	return &KafkaReaderGroup{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: cfg.KafkaBrokers,
+			GroupID: consumerGroup(cfg),
+			Topic: consumerSubject(cfg),
+			// Коммит без интервала синхронный: Commit возвращает ошибку брокера.
+			CommitInterval: 0,
+			StartOffset: kafka.FirstOffset,
+			QueueCapacity: maxInflight(cfg),
+			ErrorLogger: errorLog,
+		}),
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(cfg.KafkaBrokers...),
+			Balancer: &kafka.LeastBytes{},
+			RequiredAcks: kafka.RequireAll,
+			// Dead letters пишутся по одному, ждать пачку незачем.
+			BatchTimeout: 10 * time.Millisecond,
+			ErrorLogger: errorLog,
+		},
+	}
+}
+
+func (g *KafkaReaderGroup) Fetch(ctx context.Context) (KafkaRecord, error) {
+	m, err := g.reader.FetchMessage(ctx); if err != nil {
+		return KafkaRecord{}, err
+	}
+	return KafkaRecord{
+		Topic: m.Topic,
+		Partition: int32(m.Partition),
+		Offset: m.Offset,
+		Key: m.Key,
+		Value: m.Value,
+		Time: m.Time,
+	}, nil
+}
+
+func (g *KafkaReaderGroup) Commit(ctx context.Context, r KafkaRecord) error {
+	return g.reader.CommitMessages(ctx, kafka.Message{Topic: r.Topic, Partition: int(r.Partition), Offset: r.Offset})
+}
+
+func (g *KafkaReaderGroup) Produce(ctx context.Context, topic string, value []byte) error {
+	return g.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Value: value})
+}
+
+// Close выходит из группы и дописывает отправленные сообщения.
+func (g *KafkaReaderGroup) Close() error {
+	return errors.Join(g.reader.Close(), g.writer.Close())
+}
@@ -0,0 +1,98 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"0lvl/config"
+
+	"github.com/rs/zerolog"
+)
+
+// fetchErrorDelay — пауза перед следующим чтением из брокера после ошибки.
+const fetchErrorDelay = time.Second
+
+// Message — сообщение с ордером, полученное из Source.
+type Message struct {
+	Subject   string
+	Sequence  uint64
+	Data      []byte
+	Timestamp time.Time
+
+	ack func() error
+}
+
+// Ack подтверждает сообщение, после чего источник не доставит его повторно.
+func (m *Message) Ack() error {
+	return m.ack()
+}
+
+// Source — брокер, из которого консьюмер получает ордера.
+//
+// Доставка at-least-once: сообщение, которое не подтверждено через Ack,
+// источник доставит повторно (кроме ChanSource).
+type Source interface {
+	// Start начинает доставку сообщений в handler.
+	// handler вызывается из горутины источника и может блокироваться,
+	// пока воркеры заняты.
+	Start(handler func(*Message)) error
+
+	// Publish отправляет data в subject, используется для dead letters.
+	Publish(subject string, data []byte) error
+
+	// Close останавливает доставку и закрывает соединение.
+	// Подтвердить сообщения после Close уже нельзя.
+	Close() error
+}
+
+// NewSource подключается к брокеру, выбранному в cfg.ConsumerSource:
+// "stan", "jetstream" или "kafka" (см. NewKafkaReaderGroup).
+// ChanSource создается только в тестах через NewChanSource.
+func NewSource(cfg config.Config, log zerolog.Logger) (Source, error) {
+	switch cfg.ConsumerSource {
+	case "stan":
+		return NewStanSource(cfg)
+	case "jetstream":
+		return NewJetStreamSource(cfg, log)
+	case "kafka":
+		if len(cfg.KafkaBrokers) == 0 {
+			return nil, errors.New("kafka source needs KAFKA_BROKERS")
+		}
+		return NewKafkaSource(NewKafkaReaderGroup(cfg, log), log), nil
+	}
+	return nil, fmt.Errorf("unknown consumer source %q", cfg.ConsumerSource)
+}
+
+// consumerSubject — subject или топик, из которого читаются ордера.
+func consumerSubject(cfg config.Config) string {
+	if cfg.ConsumerSubject != "" {
+		return cfg.ConsumerSubject
+	}
+	return cfg.StanSubject
+}
+
+// consumerGroup — имя durable-консьюмера или consumer group.
+func consumerGroup(cfg config.Config) string {
+	if cfg.ConsumerGroup != "" {
+		return cfg.ConsumerGroup
+	}
+	return cfg.StanClientId
+}
+
+// consumerAckWait — сколько брокер ждет подтверждения, прежде чем доставить сообщение повторно.
+func consumerAckWait(cfg config.Config) time.Duration {
+	if cfg.ConsumerAckWait > 0 {
+		return cfg.ConsumerAckWait
+	}
+	return cfg.StanAckWait
+}
+
+// maxInflight — сколько неподтвержденных сообщений брокер может выдать консьюмеру.
+// Меньше числа воркеров смысла нет: лишние воркеры будут простаивать.
+func maxInflight(cfg config.Config) int {
+	if cfg.StanMaxInflight < cfg.ConsumerWorkers {
+		return cfg.ConsumerWorkers
+	}
+	return cfg.StanMaxInflight
+}
@@ -0,0 +1,57 @@
+package consumer
+
+import (
+	"time"
+
+	"0lvl/config"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// StanSource читает ордера из durable-подписки NATS Streaming.
+type StanSource struct {
+	sc  stan.Conn
+	sub stan.Subscription
+	cfg config.Config
+}
+
+func NewStanSource(cfg config.Config) (*StanSource, error) {
+	sc, err := stan.Connect(cfg.StanClusterId, cfg.StanClientId, stan.NatsURL(cfg.NatsUrl)); if err != nil {
+		return nil, err
+	}
+	return &StanSource{sc: sc, cfg: cfg}, nil
+}
+
+func (s *StanSource) Start(handler func(*Message)) error {
+	cb := func(m *stan.Msg) {
+		handler(&Message{
+			Subject: m.Subject,
+			Sequence: m.Sequence,
+			Data: m.Data,
+			Timestamp: time.Unix(0, m.Timestamp),
+			ack: m.Ack,
+		})
+	}
+	// AckWait должен перекрывать все повторы одного сообщения, иначе STAN доставит его еще раз.
+	sub, err := s.sc.Subscribe(s.cfg.StanSubject, cb, stan.SetManualAckMode(), stan.DurableName(s.cfg.StanClientId),
+		stan.AckWait(s.cfg.StanAckWait), stan.MaxInflight(maxInflight(s.cfg))); if err != nil {
+		return err
+	}
+	s.sub = sub
+	return nil
+}
+
+func (s *StanSource) Publish(subject string, data []byte) error {
+	return s.sc.Publish(subject, data)
+}
+
+// Close закрывает подписку и соединение. Durable-подписка сохраняется.
+func (s *StanSource) Close() error {
+	if s.sub != nil {
+		err := s.sub.Close(); if err != nil {
+			s.sc.Close()
+			return err
+		}
+	}
+	return s.sc.Close()
+}
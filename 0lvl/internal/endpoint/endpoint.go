@@ -2,8 +2,12 @@ package endpoint
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"0lvl/internal/consumer"
 	"0lvl/internal/repository"
 
 	"github.com/julienschmidt/httprouter"
@@ -13,23 +17,31 @@ import (
 
 var (
 	msgNoData = []byte(`{"message": "No data"}`)
+	msgOk     = []byte(`{"message": "OK"}`)
 )
 
 
 type Endpoint struct {
     repo *repository.Repo
+	consumer *consumer.Consumer
 	log   zerolog.Logger
 }
 
-func Run(ctx context.Context, repo *repository.Repo, log zerolog.Logger) error {
+func Run(ctx context.Context, repo *repository.Repo, cons *consumer.Consumer, log zerolog.Logger) error {
 	h := Endpoint{
 		repo: repo,
+		consumer: cons,
 		log: log,
 	}
     router := httprouter.New()
     router.GET("/", h.index)
     router.GET("/order/:uid", h.order)
 	router.GET("/metric", h.metric)
+	router.GET("/metric/consumer", h.consumerMetric)
+	router.GET("/admin/cache", h.cachedOrders)
+	router.POST("/admin/cache/invalidate", h.invalidateOrders)
+	router.GET("/admin/dead-letters", h.deadLetters)
+	router.POST("/admin/dead-letters/:id/redrive", h.redriveDeadLetter)
 
 	server := &http.Server{
 		Addr:    ":8000",
@@ -56,6 +68,80 @@ func (h *Endpoint) order(w http.ResponseWriter, r *http.Request, ps httprouter.P
 }
 
 func (h *Endpoint) metric(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	b := h.repo.Metric()
+	b := h.repo.Metric(r.URL.Query().Has("detailed"))
 	w.Write(b)
-}
\ No newline at end of file
+}
+
+func (h *Endpoint) consumerMetric(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Write(h.consumer.Metric())
+}
+
+func (h *Endpoint) cachedOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	b := h.repo.CachedOrderUids()
+	w.Write(b)
+}
+
+// invalidateOrders удаляет из кеша ордера, uid которых переданы в теле
+// запроса как {"uids": [...]}, и отвечает, сколько из них было в кеше.
+func (h *Endpoint) invalidateOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Uids []string `json:"uids"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req); if err != nil || len(req.Uids) == 0 {
+		writeError(w, http.StatusBadRequest, `body must be {"uids": [...]} with at least one uid`)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Invalidated int `json:"invalidated"`
+	}{h.repo.InvalidateOrders(req.Uids)})
+	w.Write(b)
+}
+
+// deadLetters отдает последние dead letters, ?limit= задает их количество (по умолчанию 32).
+func (h *Endpoint) deadLetters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := 32
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s); if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	b, err := h.repo.DeadLetters(limit); if err != nil {
+		h.log.Err(err).Msg("")
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Write(b)
+}
+
+// redriveDeadLetter повторно сохраняет ордер из dead letter.
+func (h *Endpoint) redriveDeadLetter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64); if err != nil {
+		writeError(w, http.StatusBadRequest, "id must be an integer")
+		return
+	}
+	err = h.repo.RedriveDeadLetter(id); if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrDeadLetterNotFound):
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, repository.ErrInvalidOrder):
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, repository.ErrOrderConflict):
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			h.log.Err(err).Msg("")
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	w.Write(msgOk)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	b, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{msg})
+	w.WriteHeader(status)
+	w.Write(b)
+}
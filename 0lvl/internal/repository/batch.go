@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrRepoClosed возвращается SaveOrder после Close.
+var ErrRepoClosed = errors.New("repository closed")
+
+// saveRequest — ордер, ждущий записи в пачке.
+type saveRequest struct {
+	order *Order
+	msg   []byte
+	done  chan error
+}
+
+// batchWriter копит ордера из конкурентных SaveOrder и пишет их в db
+// одной транзакцией, когда набралось size ордеров или прошло wait
+// с первого ордера пачки. Каждый SaveOrder ждет коммита своей пачки.
+type batchWriter struct {
+	r    *Repo
+	size int
+	wait time.Duration
+
+	reqs    chan saveRequest
+	stop    chan struct{}
+	stopped chan struct{}
+
+	batches uint64
+	orders  uint64
+}
+
+func newBatchWriter(r *Repo, size int, wait time.Duration) *batchWriter {
+	w := &batchWriter{
+		r: r,
+		size: size,
+		wait: wait,
+		reqs: make(chan saveRequest),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// save ставит ордер в пачку и возвращает результат его записи.
+func (w *batchWriter) save(d *Order, msg []byte) error {
+	req := saveRequest{order: d, msg: msg, done: make(chan error, 1)}
+	select {
+	case w.reqs <- req:
+	case <-w.stopped:
+		return ErrRepoClosed
+	}
+	return <-req.done
+}
+
+// Close дописывает ордера, уже принятые в пачку, и останавливает writer.
+func (w *batchWriter) Close() {
+	close(w.stop)
+	<-w.stopped
+}
+
+func (w *batchWriter) run() {
+	defer close(w.stopped)
+	batch := make([]saveRequest, 0, w.size)
+	for {
+		select {
+		case req := <-w.reqs:
+			batch = append(batch, req)
+		case <-w.stop:
+			return
+		}
+
+		timer := time.NewTimer(w.wait)
+	collect:
+		for len(batch) < w.size {
+			select {
+			case req := <-w.reqs:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.flush(batch)
+		for i := range batch {
+			batch[i] = saveRequest{}
+		}
+		batch = batch[:0]
+	}
+}
+
+// flush пишет пачку одной транзакцией через pgx.Batch.
+//
+// Временная ошибка возвращается всем ордерам пачки, чтобы их повторили.
+// При постоянной ошибке ордера пишутся по одному, и ошибку получает
+// только тот ордер, который ее вызвал.
+func (w *batchWriter) flush(batch []saveRequest) {
+	atomic.AddUint64(&w.batches, 1)
+	atomic.AddUint64(&w.orders, uint64(len(batch)))
+
+	inserted, existing, err := w.insert(batch)
+	if err != nil {
+		if IsTransient(err) {
+			for _, req := range batch {
+				req.done <- err
+			}
+			return
+		}
+		w.r.log.Warn().Err(err).Int("orders", len(batch)).Msg("batch failed, saving orders one by one")
+		for _, req := range batch {
+			req.done <- w.r.saveOne(req.order, req.msg)
+		}
+		return
+	}
+
+	for i, req := range batch {
+		if inserted[i] {
+			w.r.cacheSaved(req.order, req.msg)
+			req.done <- nil
+			continue
+		}
+		entity, ok := existing[req.order.OrderUid]
+		if !ok {
+			// Строку удалили между INSERT и SELECT пачки.
+			req.done <- w.r.checkDuplicate(req.order)
+			continue
+		}
+		req.done <- w.r.compareDuplicate(req.order, entity)
+	}
+}
+
+// insert выполняет INSERT всех ордеров пачки в одной транзакции
+// и возвращает, какие из них добавили строку, и сохраненное содержимое
+// остальных по order_uid.
+//
+// Уведомления о добавленных ордерах ставятся в ту же транзакцию вторым
+// pgx.Batch вместе с чтением дубликатов: другие экземпляры получат их
+// только после коммита, а пачка обходится двумя обменами с db.
+func (w *batchWriter) insert(batch []saveRequest) ([]bool, map[string][]byte, error) {
+	ctx := context.Background()
+	tx, err := w.r.db.Begin(ctx); if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	b := &pgx.Batch{}
+	for _, req := range batch {
+		b.Queue(sqlInsertOrder, req.order.OrderUid, req.order.DateCreated.UnixMicro(), req.msg)
+	}
+	br := tx.SendBatch(ctx, b)
+	inserted := make([]bool, len(batch))
+	var added, duplicates []string
+	for i, req := range batch {
+		tag, err := br.Exec(); if err != nil {
+			br.Close()
+			return nil, nil, err
+		}
+		inserted[i] = tag.RowsAffected() > 0
+		if inserted[i] {
+			added = append(added, req.order.OrderUid)
+		} else {
+			duplicates = append(duplicates, req.order.OrderUid)
+		}
+	}
+	err = br.Close(); if err != nil {
+		return nil, nil, err
+	}
+
+	b = &pgx.Batch{}
+	if len(added) > 0 {
+		w.r.queueInvalidations(b, added)
+	}
+	if len(duplicates) > 0 {
+		const sql = `SELECT pk, entity FROM trade WHERE pk = ANY($1);`
+		b.Queue(sql, duplicates)
+	}
+	existing := make(map[string][]byte, len(duplicates))
+	if b.Len() > 0 {
+		br = tx.SendBatch(ctx, b)
+		if len(added) > 0 {
+			_, err = br.Exec(); if err != nil {
+				br.Close()
+				return nil, nil, err
+			}
+		}
+		if len(duplicates) > 0 {
+			rows, err := br.Query(); if err != nil {
+				br.Close()
+				return nil, nil, err
+			}
+			for rows.Next() {
+				var pk string
+				var entity []byte
+				err = rows.Scan(&pk, &entity); if err != nil {
+					rows.Close()
+					br.Close()
+					return nil, nil, err
+				}
+				existing[pk] = entity
+			}
+			rows.Close()
+			err = rows.Err(); if err != nil {
+				br.Close()
+				return nil, nil, err
+			}
+		}
+		err = br.Close(); if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = tx.Commit(ctx); if err != nil {
+		return nil, nil, err
+	}
+	return inserted, existing, nil
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// bloomFilter — фильтр Блума по uid сохраненных ордеров.
+// Add и Has безопасны для конкурентного вызова без блокировок.
+//
+// Ложноотрицательных ответов нет. Если ордеров больше, чем ожидалось
+// при создании, растет только доля ложноположительных.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// newBloomFilter создает фильтр на n ключей с долей ложноположительных p.
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		hashes: k,
+	}
+}
+
+// positions вызывает f для каждого бита ключа k (двойное хеширование).
+func (f *bloomFilter) positions(k []byte, fn func(word int, mask uint64) bool) {
+	h := xxhash.Sum64(k)
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) Add(k []byte) {
+	f.positions(k, func(word int, mask uint64) bool {
+		for {
+			old := atomic.LoadUint64(&f.bits[word])
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.bits[word], old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+// Has возвращает false, только если k точно не добавлялся.
+func (f *bloomFilter) Has(k []byte) bool {
+	found := true
+	f.positions(k, func(word int, mask uint64) bool {
+		found = atomic.LoadUint64(&f.bits[word])&mask != 0
+		return found
+	})
+	return found
+}
+
+// orderKnown сообщает, может ли ордер uid быть в db.
+// Пока фильтр не заполнен, ответ всегда true.
+func (r *Repo) orderKnown(uid string) bool {
+	if r.bloom == nil || !r.bloomReady() {
+		return true
+	}
+	if r.bloom.Has(s2b(uid)) {
+		return true
+	}
+	atomic.AddUint64(&r.bloomRejects, 1)
+	return false
+}
+
+// rememberOrder добавляет uid сохраненного ордера в фильтр.
+func (r *Repo) rememberOrder(uid string) {
+	if r.bloom != nil {
+		r.bloom.Add(s2b(uid))
+	}
+}
+
+// fillBloom добавляет в фильтр uid всех ордеров из db.
+// Вызывается listener после каждой подписки на уведомления.
+//
+// Фильтр только растет, поэтому повторное заполнение после потери уведомлений
+// дописывает ордера, сохраненные другими экземплярами.
+// Пока оно идет, фильтр не используется: в нем может не быть таких ордеров.
+func (r *Repo) fillBloom(ctx context.Context) {
+	defer r.bloomFills.Done()
+	r.bloomFill.Lock()
+	defer r.bloomFill.Unlock()
+
+	epoch := r.resetBloomReady(false)
+	const sql = `SELECT pk FROM trade;`
+	rows, err := r.db.Query(ctx, sql); if err != nil {
+		r.log.Err(err).Msg("bloom filter not filled")
+		return
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		r.bloom.Add(rows.RawValues()[0])
+		n++
+	}
+	err = rows.Err(); if err != nil {
+		r.log.Err(err).Msg("bloom filter not filled")
+		return
+	}
+	// Если за время заполнения уведомления терялись, готовым фильтр сделает
+	// следующее заполнение, которое запустит listener.
+	if !atomic.CompareAndSwapUint64(&r.bloomState, epoch<<1, epoch<<1|1) {
+		return
+	}
+	r.log.Info().Int("orders", n).Msg("bloom filter filled")
+}
+
+// bloomReady сообщает, что фильтр заполнен и уведомления с тех пор не терялись.
+func (r *Repo) bloomReady() bool {
+	return atomic.LoadUint64(&r.bloomState)&1 == 1
+}
+
+// resetBloomReady помечает фильтр незаполненным и возвращает эпоху.
+// С lost эпоха увеличивается, и заполнение, начатое раньше, уже не сделает фильтр готовым.
+func (r *Repo) resetBloomReady(lost bool) uint64 {
+	for {
+		old := atomic.LoadUint64(&r.bloomState)
+		epoch := old >> 1
+		if lost {
+			epoch++
+		}
+		if atomic.CompareAndSwapUint64(&r.bloomState, old, epoch<<1) {
+			return epoch
+		}
+	}
+}
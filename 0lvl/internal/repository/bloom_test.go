@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	f := newBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.Add([]byte(fmt.Sprintf("order %d", i)))
+	}
+	for i := 0; i < n; i++ {
+		if !f.Has([]byte(fmt.Sprintf("order %d", i))) {
+			t.Fatalf("added key %d not found", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if f.Has([]byte(fmt.Sprintf("random %d", i))) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.02 {
+		t.Fatalf("false positive rate %.3f; want about 0.01", rate)
+	}
+}
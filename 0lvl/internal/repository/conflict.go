@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ErrOrderConflict — общая причина ConflictError, проверяется через errors.Is.
+var ErrOrderConflict = errors.New("order conflict")
+
+// FieldDiff — поле, значение которого различается у сохраненного и нового ордера.
+// Отсутствующее поле — nil.
+type FieldDiff struct {
+	Field    string `json:"field"`
+	Existing any    `json:"existing"`
+	Incoming any    `json:"incoming"`
+}
+
+// ConflictError возвращается SaveOrder, если ордер с таким order_uid
+// уже сохранен с другим содержимым.
+type ConflictError struct {
+	OrderUid string      `json:"order_uid"`
+	Fields   []FieldDiff `json:"fields"`
+}
+
+func (e *ConflictError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%s: %v != %v", f.Field, f.Existing, f.Incoming))
+	}
+	return fmt.Sprintf("order %q already saved with other content: %s", e.OrderUid, strings.Join(fields, "; "))
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrOrderConflict
+}
+
+// diffOrders сравнивает два ордера по их JSON-представлению
+// и возвращает различающиеся поля в порядке путей.
+func diffOrders(existing, incoming *Order) []FieldDiff {
+	var a, b any
+	ea, _ := json.Marshal(existing)
+	eb, _ := json.Marshal(incoming)
+	_ = json.Unmarshal(ea, &a)
+	_ = json.Unmarshal(eb, &b)
+
+	var diffs []FieldDiff
+	diffValues(&diffs, "", a, b)
+	return diffs
+}
+
+func diffValues(diffs *[]FieldDiff, path string, a, b any) {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			diffValues(diffs, field, av[k], bv[k])
+		}
+		return
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		n := len(av)
+		if len(bv) > n {
+			n = len(bv)
+		}
+		for i := 0; i < n; i++ {
+			var ai, bi any
+			if i < len(av) {
+				ai = av[i]
+			}
+			if i < len(bv) {
+				bi = bv[i]
+			}
+			diffValues(diffs, fmt.Sprintf("%s[%d]", path, i), ai, bi)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, FieldDiff{Field: path, Existing: a, Incoming: b})
+	}
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffOrders(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *Order)
+		want   []string
+	}{
+		{
+			name: "same",
+			change: func(o *Order) {},
+		},
+		{
+			name: "scalar fields",
+			change: func(o *Order) {
+				o.TrackNumber = "OTHER"
+				o.Payment.Amount = 1818
+			},
+			want: []string{"payment.amount", "track_number"},
+		},
+		{
+			name: "item field",
+			change: func(o *Order) { o.Items[1].Price = 101 },
+			want: []string{"items[1].price"},
+		},
+		{
+			name: "extra item",
+			change: func(o *Order) { o.Items = append(o.Items, Item{}) },
+			want: []string{"items[2]"},
+		},
+		{
+			name: "no items",
+			change: func(o *Order) { o.Items = nil },
+			want: []string{"items"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing, incoming := testOrder(), testOrder()
+			tt.change(incoming)
+			diffs := diffOrders(existing, incoming)
+			var fields []string
+			for _, d := range diffs {
+				fields = append(fields, d.Field)
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(tt.want) {
+				t.Fatalf("diffOrders fields %v; want %v", fields, tt.want)
+			}
+		})
+	}
+
+	// Отсутствующий у одного из ордеров элемент — nil, значения — из JSON.
+	existing, incoming := testOrder(), testOrder()
+	incoming.Items = incoming.Items[:1]
+	incoming.Payment.Amount = 1818
+	diffs := diffOrders(existing, incoming)
+	if len(diffs) != 2 {
+		t.Fatalf("diffOrders: %+v", diffs)
+	}
+	if d := diffs[0]; d.Field != "items[1]" || d.Existing == nil || d.Incoming != nil {
+		t.Fatalf("removed item diff: %+v", d)
+	}
+	if d := diffs[1]; d.Field != "payment.amount" || d.Existing != float64(1817) || d.Incoming != float64(1818) {
+		t.Fatalf("amount diff: %+v", d)
+	}
+}
+
+func TestConflictError(t *testing.T) {
+	var err error = &ConflictError{
+		OrderUid: "b563feb7b2b84b6test",
+		Fields: []FieldDiff{{Field: "payment.amount", Existing: 1817, Incoming: 1818}},
+	}
+	if !errors.Is(err, ErrOrderConflict) {
+		t.Fatalf("errors.Is(%v, ErrOrderConflict) = false", err)
+	}
+	if errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("conflict is an invalid order")
+	}
+	wrapped := fmt.Errorf("save order: %w", err)
+	var ce *ConflictError
+	if !errors.As(wrapped, &ce) || ce.OrderUid != "b563feb7b2b84b6test" {
+		t.Fatalf("errors.As(%v) = %+v", wrapped, ce)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "b563feb7b2b84b6test") || !strings.Contains(msg, "payment.amount: 1817 != 1818") {
+		t.Fatalf("Error() = %q", msg)
+	}
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrDeadLetterNotFound возвращается, если dead letter с таким id нет
+// или он уже переотправлен.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// SaveDeadLetter сохраняет сообщение, которое не удалось обработать,
+// вместе с ошибкой, чтобы его можно было разобрать и переотправить.
+func (r *Repo) SaveDeadLetter(d DeadLetter) error {
+	const sql = `INSERT INTO trade_dead_letter (subject, sequence, payload, error, received_at) VALUES ($1, $2, $3, $4, $5);`
+	_, err := r.db.Exec(context.Background(), sql, d.Subject, int64(d.Sequence), d.Payload, d.Error, d.ReceivedAt)
+	return err
+}
+
+// DeadLetters отдает последние count dead letters, которые еще не переотправлены.
+func (r *Repo) DeadLetters(count int) ([]byte, error) {
+	const sql = `SELECT id, subject, sequence, payload, error, received_at FROM trade_dead_letter
+		WHERE redriven_at IS NULL ORDER BY id DESC LIMIT $1;`
+	rows, err := r.db.Query(context.Background(), sql, count); if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]DeadLetter, 0, count)
+	for rows.Next() {
+		var d DeadLetter
+		var seq int64
+		err = rows.Scan(&d.Id, &d.Subject, &seq, &d.Payload, &d.Error, &d.ReceivedAt); if err != nil {
+			return nil, err
+		}
+		d.Sequence = uint64(seq)
+		letters = append(letters, d)
+	}
+	err = rows.Err(); if err != nil {
+		return nil, err
+	}
+
+	b, _ := json.Marshal(letters)
+	return b, nil
+}
+
+// RedriveDeadLetter повторно сохраняет ордер из dead letter id.
+// При успехе dead letter помечается переотправленным, при ошибке
+// в нем обновляется текст ошибки и она возвращается.
+func (r *Repo) RedriveDeadLetter(id int64) error {
+	var payload []byte
+	const sqlGet = `SELECT payload FROM trade_dead_letter WHERE id = $1 AND redriven_at IS NULL;`
+	err := r.db.QueryRow(context.Background(), sqlGet, id).Scan(&payload); if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrDeadLetterNotFound
+		}
+		return err
+	}
+
+	saveErr := r.SaveOrder(payload)
+	if saveErr != nil {
+		const sqlFail = `UPDATE trade_dead_letter SET error = $2 WHERE id = $1;`
+		_, err = r.db.Exec(context.Background(), sqlFail, id, saveErr.Error()); if err != nil {
+			r.log.Err(err).Int64("id", id).Msg("dead letter not updated")
+		}
+		return fmt.Errorf("redrive dead letter %d: %w", id, saveErr)
+	}
+
+	const sqlDone = `UPDATE trade_dead_letter SET redriven_at = $2 WHERE id = $1;`
+	_, err = r.db.Exec(context.Background(), sqlDone, id, time.Now())
+	return err
+}
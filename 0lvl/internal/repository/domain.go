@@ -65,7 +65,31 @@ type OrderLink struct {
 	Rank    uint64    `json:"rank"`
 }
 
+// DeadLetter — сообщение из очереди, которое не удалось сохранить.
+type DeadLetter struct {
+	Id         int64     `json:"id"`
+	Subject    string    `json:"subject"`
+	Sequence   uint64    `json:"sequence"`
+	// Payload — исходное сообщение как есть, в JSON кодируется base64:
+	// оно может быть невалидным UTF-8.
+	Payload    []byte    `json:"payload"`
+	Error      string    `json:"error"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
 type Monitor struct {
 	DatabaseOrderCount int
 	Cache cache.Stats
+	CacheHitRatio float64
+	NotFoundCache cache.Stats
+	OrderListCache cache.Stats
+	InvalidationsReceived uint64
+	DeadLetterCount int
+	OrderDuplicates uint64
+	OrderConflicts  uint64
+	DbBatches       uint64
+	DbBatchedOrders uint64
+	BloomReady      bool
+	BloomRejects    uint64
+	CacheDetails *cache.DetailedStats `json:",omitempty"`
 }
\ No newline at end of file
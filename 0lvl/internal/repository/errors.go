@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsTransient сообщает, может ли повтор той же операции завершиться успешно:
+// ошибка вызвана потерей соединения с db, таймаутом или временной перегрузкой.
+// Ошибки валидации и разбора ордера постоянные.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrInvalidOrder) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exception
+			strings.HasPrefix(pgErr.Code, "53"), // insufficient resources
+			pgErr.Code == "40001",               // serialization failure
+			pgErr.Code == "40P01",               // deadlock detected
+			pgErr.Code == "57P01",               // admin shutdown
+			pgErr.Code == "57P02",               // crash shutdown
+			pgErr.Code == "57P03":               // cannot connect now
+			return true
+		}
+		return false
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "other", err: errors.New("some error"), want: false},
+		{name: "invalid order", err: validateTestOrder(func(o *Order) { o.OrderUid = "" }), want: false},
+		{name: "wrapped invalid order", err: fmt.Errorf("save: %w", validateTestOrder(func(o *Order) { o.Entry = "" })), want: false},
+		{name: "conflict", err: &ConflictError{OrderUid: "uid"}, want: false},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: true},
+		{name: "connection exception", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "too many connections", err: &pgconn.PgError{Code: "53300"}, want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}, want: true},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, want: true},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}, want: true},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "undefined table", err: fmt.Errorf("insert: %w", &pgconn.PgError{Code: "42P01"}), want: false},
+		{name: "net", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("broken")}, want: true},
+		{name: "eof", err: fmt.Errorf("read: %w", io.EOF), want: true},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, want: true},
+		{name: "connection refused", err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED), want: true},
+		{name: "connection reset", err: syscall.ECONNRESET, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Fatalf("IsTransient(%v) = %v; want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// validateTestOrder возвращает ошибку Validate ордера testOrder, измененного change.
+func validateTestOrder(change func(o *Order)) error {
+	o := testOrder()
+	change(o)
+	return o.Validate()
+}
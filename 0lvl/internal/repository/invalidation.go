@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// listenRetryDelay пауза перед повторным LISTEN после потери соединения.
+const listenRetryDelay = time.Second
+
+// newInstanceId возвращает случайный id экземпляра сервиса,
+// по которому listener отличает свои уведомления от чужих.
+func newInstanceId() (string, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:]); if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// notifyInvalidation сообщает другим экземплярам, что ордер uid изменился.
+// Полезная нагрузка уведомления — "instanceId:uid".
+func (r *Repo) notifyInvalidation(uid string) error {
+	const sql = `SELECT pg_notify($1, $2);`
+	_, err := r.db.Exec(context.Background(), sql, r.invalidationChannel, r.invalidationPayload(uid))
+	return err
+}
+
+// queueInvalidations ставит в b одно уведомление на каждый ордер из uids.
+// Уведомления, отправленные в транзакции, доставляются только после ее коммита.
+func (r *Repo) queueInvalidations(b *pgx.Batch, uids []string) {
+	payloads := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		payloads = append(payloads, r.invalidationPayload(uid))
+	}
+	const sql = `SELECT pg_notify($1, p) FROM unnest($2::text[]) AS p;`
+	b.Queue(sql, r.invalidationChannel, payloads)
+}
+
+func (r *Repo) invalidationPayload(uid string) string {
+	return r.instanceId + ":" + uid
+}
+
+// listenInvalidations слушает канал инвалидации на отдельном соединении из пула
+// и удаляет из кеша ордера, измененные другими экземплярами, пока не отменен ctx.
+//
+// Уведомления, пришедшие пока соединения не было, теряются,
+// поэтому после переподключения кеш ордеров и кеш промахов очищаются целиком:
+// ордер, сохраненный за это время другим экземпляром, не должен остаться ненайденным.
+func (r *Repo) listenInvalidations(ctx context.Context) {
+	defer close(r.listenDone)
+
+	reconnect := false
+	for {
+		err := r.listen(ctx, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+		r.log.Err(err).Str("channel", r.invalidationChannel).Msg("invalidation listener stopped")
+		reconnect = true
+		// Без уведомлений фильтр не узнает об ордерах других экземпляров.
+		r.resetBloomReady(true)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (r *Repo) listen(ctx context.Context, reconnect bool) error {
+	pooled, err := r.db.Acquire(ctx); if err != nil {
+		return err
+	}
+	// Соединение с LISTEN нельзя возвращать в пул: другой запрос получил бы его подписку.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{r.invalidationChannel}.Sanitize()); if err != nil {
+		return err
+	}
+	if reconnect {
+		r.cache.Reset()
+		r.notFound.Reset()
+		r.log.Warn().Msg("cache reset after invalidation listener reconnect")
+	}
+	// Ордера, сохраненные другими экземплярами после этого момента, придут уведомлениями,
+	// а сохраненные раньше (или пока соединения не было) дочитываются из db.
+	if r.bloom != nil {
+		r.bloomFills.Add(1)
+		go r.fillBloom(ctx)
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx); if err != nil {
+			return err
+		}
+		instanceId, uid, ok := strings.Cut(n.Payload, ":")
+		if !ok {
+			r.log.Err(errors.New("bad invalidation payload")).Str("payload", n.Payload).Msg("")
+			continue
+		}
+		if instanceId == r.instanceId {
+			continue
+		}
+		atomic.AddUint64(&r.invalidationsReceived, 1)
+		r.cache.Del(s2b(uid))
+		r.notFound.Del(s2b(uid))
+		r.rememberOrder(uid)
+	}
+}
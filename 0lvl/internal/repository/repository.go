@@ -4,91 +4,321 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"0lvl/config"
 	"0lvl/pkg/cache"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 )
 
 
 const (
-	// maxCacheBytes максимальный размер кеша (FIFO).
-	maxCacheBytes = 1024 * 1024 * 32
-
 	// entryByteSize примерный размер кешированного ордера в байтах.
 	// если это будет меньше чем по факту то запрос в db при старте будет с большим лимитом
-	// чем влезет в кеш
+	// чем влезет в кеш.
+	// Используется для количества ордеров прогрева, если CacheWarmUpCount не задан.
 	entryByteSize = 1200
 
-	// initCacheCount количество ордеров из db для прогрева кеша при старте.
-	initCacheCount = maxCacheBytes / entryByteSize
+	// notFoundCacheBytes квота пространства имен uid, которых нет в db.
+	// Хранятся только ключи, поэтому квота мелкая.
+	notFoundCacheBytes = 1024 * 1024
+
+	// orderListCacheBytes квота пространства имен ответов GetOrderList.
+	orderListCacheBytes = 1024 * 1024
+
+	// hotKeysTop сколько горячих ключей отдавать в подробной статистике кеша.
+	hotKeysTop = 32
 )
 
+// ErrOrderNotFound возвращается, если ордера с таким uid нет в db.
+var ErrOrderNotFound = errors.New("order not found")
+
 
 type Repo struct {
-	db    *pgxpool.Pool
-	log   zerolog.Logger
-	cache *cache.Cache
+	db        *pgxpool.Pool
+	log       zerolog.Logger
+	cache     *cache.Cache
+	cacheFile string
+	cacheTTL  time.Duration
+
+	// warmUpCount количество ордеров из db для прогрева кеша при старте.
+	warmUpCount int
+
+	// notFound помнит uid, которых не нашлось в db, чтобы запросы
+	// несуществующих ордеров не доходили до db.
+	notFound    *cache.Namespace
+	notFoundTTL time.Duration
+
+	// orderList хранит ответы GetOrderList по count отдельно от ордеров,
+	// чтобы списки и ордера не вытесняли друг друга.
+	orderList    *cache.Namespace
+	orderListTTL time.Duration
+
+	// instanceId отличает уведомления об инвалидации этого экземпляра от чужих.
+	instanceId            string
+	invalidationChannel   string
+	invalidationsReceived uint64
+	listenCancel          context.CancelFunc
+	listenDone            chan struct{}
+
+	// orderDuplicates — повторно доставленные ордера, которые уже сохранены,
+	// orderConflicts — ордера с сохраненным order_uid и другим содержимым.
+	orderDuplicates uint64
+	orderConflicts  uint64
+
+	// batch пишет ордера пачками, nil если DbBatchSize <= 1.
+	batch *batchWriter
+
+	// bloom отсекает запросы uid, которых точно нет в db, в том числе
+	// случайных, которых нет и в notFound. nil если BloomExpectedOrders == 0.
+	// bloomState — эпоха<<1 | фильтр заполнен, см. bloomReady.
+	// bloomFill не дает заполнять фильтр одновременно дважды.
+	bloom        *bloomFilter
+	bloomState   uint64
+	bloomRejects uint64
+	bloomFill    sync.Mutex
+	bloomFills   sync.WaitGroup
 }
 
 func New(ctx context.Context, log zerolog.Logger, cfg config.Config) (*Repo, error) {
 	db, err := pgxpool.New(ctx, cfg.PgString); if err != nil {
 		return nil, err
 	}
-	cache, err := cache.New(maxCacheBytes); if err != nil {
+	// Снапшот с диска поднимает горячий кеш без запросов в db.
+	// Если его нет или он поврежден — прогреваем кеш из db как раньше.
+	compression, err := cache.ParseCompression(cfg.CacheCompression); if err != nil {
+		return nil, err
+	}
+	// Квоты пространств имен вырезаются из CacheMaxBytes, кеш ордеров получает остаток.
+	opts := cache.Options{
+		MaxBytes: cfg.CacheMaxBytes,
+		NamespaceBytes: notFoundCacheBytes + orderListCacheBytes,
+		BucketsCount: cfg.CacheBucketsCount,
+		ChunkSize: cfg.CacheChunkSize,
+		ChunksPerAlloc: cfg.CacheChunksPerAlloc,
+		AdmitMinFrequency: cfg.CacheAdmitMinFrequency,
+		PromoteOnHit: cfg.CachePromoteOnHit,
+		Compression: compression,
+		HotKeysSampleRate: cfg.CacheHotKeysSampleRate,
+		DiskPath: cfg.CacheDiskPath,
+		DiskMaxBytes: cfg.CacheDiskMaxBytes,
+	}
+	warmUp := false
+	c, err := cache.LoadFromFileWithOptions(cfg.CacheFile, opts); if err != nil {
+		log.Warn().Err(err).Str("file", cfg.CacheFile).Msg("cache snapshot not loaded")
+		c, err = cache.NewWithOptions(opts); if err != nil {
+			return nil, err
+		}
+		warmUp = true
+	}
+	notFound, err := c.Namespace("not-found", notFoundCacheBytes); if err != nil {
+		return nil, err
+	}
+	orderList, err := c.Namespace("order-list", orderListCacheBytes); if err != nil {
+		return nil, err
+	}
+	instanceId, err := newInstanceId(); if err != nil {
 		return nil, err
 	}
     repo := &Repo{
 		db: db,
 		log: log,
-		cache: cache,
+		cache: c,
+		cacheFile: cfg.CacheFile,
+		cacheTTL: cfg.CacheTTL,
+		warmUpCount: cfg.CacheWarmUpCount,
+		notFound: notFound,
+		notFoundTTL: cfg.NotFoundTTL,
+		orderList: orderList,
+		orderListTTL: cfg.OrderListTTL,
+		instanceId: instanceId,
+		invalidationChannel: cfg.InvalidationChannel,
+		listenDone: make(chan struct{}),
 	}
 
-	go repo.cacheWarmUp()
+	if cfg.DbBatchSize > 1 {
+		repo.batch = newBatchWriter(repo, cfg.DbBatchSize, cfg.DbBatchWait)
+	}
+
+	if repo.warmUpCount <= 0 {
+		repo.warmUpCount = int(cfg.CacheMaxBytes / entryByteSize)
+	}
+
+	listenCtx, listenCancel := context.WithCancel(ctx)
+	repo.listenCancel = listenCancel
+	// Фильтр заполняет listener, когда подписан на уведомления.
+	if cfg.BloomExpectedOrders > 0 {
+		repo.bloom = newBloomFilter(cfg.BloomExpectedOrders, cfg.BloomFalsePositiveRate)
+	}
+	go repo.listenInvalidations(listenCtx)
+
+	if warmUp {
+		go repo.cacheWarmUp()
+	} else {
+		log.Info().Str("file", cfg.CacheFile).Msg("cache loaded from snapshot")
+	}
 
 	return repo, nil
 }
 
 func (r *Repo) Close() {
+	r.listenCancel()
+	<-r.listenDone
+	r.bloomFills.Wait()
+	if r.batch != nil {
+		r.batch.Close()
+	}
+
+	err := r.cache.SaveToFile(r.cacheFile); if err != nil {
+		r.log.Err(err).Str("file", r.cacheFile).Msg("cache snapshot not saved")
+	}
+	// Пространства имен закрываются вместе с кешем.
+	err = r.cache.Close(); if err != nil {
+		r.log.Err(err).Msg("")
+	}
 	r.db.Close()
 }
 
+// SaveOrder сохраняет ордер в db и кеш.
+// Неразбираемый или невалидный ордер отклоняется ошибкой,
+// для которой errors.Is(err, ErrInvalidOrder), см. Order.Validate.
+//
+// Повторное сохранение того же ордера ничего не делает, а ордер
+// с уже сохраненным order_uid, но другим содержимым возвращает *ConflictError.
 func (r *Repo) SaveOrder(msg []byte) error {
     var d Order
 	err := json.Unmarshal(msg, &d); if err != nil {
-		return err
+		return fmt.Errorf("%w: %s", ErrInvalidOrder, err)
 	}
-	const sql = `INSERT INTO trade (pk, rang, entity) VALUES ($1, $2, $3);`
-	_, err = r.db.Exec(context.Background(), sql, d.OrderUid, d.DateCreated.UnixMicro(), msg); if err != nil {
+	err = d.Validate(); if err != nil {
 		return err
 	}
+	if r.batch != nil {
+		return r.batch.save(&d, msg)
+	}
+	return r.saveOne(&d, msg)
+}
 
-    err = r.cache.Set(s2b(d.OrderUid), msg); if err != nil {
-        r.log.Err(err).Msg("")
+const sqlInsertOrder = `INSERT INTO trade (pk, rang, entity) VALUES ($1, $2, $3) ON CONFLICT (pk) DO NOTHING;`
+
+// saveOne сохраняет проверенный ордер d отдельным запросом.
+func (r *Repo) saveOne(d *Order, msg []byte) error {
+	tag, err := r.db.Exec(context.Background(), sqlInsertOrder, d.OrderUid, d.DateCreated.UnixMicro(), msg); if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return r.checkDuplicate(d)
 	}
+	return r.afterInsert(d, msg)
+}
 
+// afterInsert обновляет кеши и уведомляет другие экземпляры о новом ордере d.
+func (r *Repo) afterInsert(d *Order, msg []byte) error {
+	r.cacheSaved(d, msg)
+	err := r.notifyInvalidation(d.OrderUid); if err != nil {
+		r.log.Err(err).Msg("")
+	}
 	return nil
 }
 
+// cacheSaved обновляет кеши новым ордером d без запросов в db.
+func (r *Repo) cacheSaved(d *Order, msg []byte) {
+	// Версия — время создания ордера, поэтому запоздавшая старая запись
+	// не затрет в кеше более новую. Новый ордер, как и при Set, проходит допуск
+	// по частоте CacheAdmitMinFrequency: редкий ордер загрузится из db при первом чтении.
+	_, err := r.cache.SetIfNewerWithTTL(s2b(d.OrderUid), msg, uint64(d.DateCreated.UnixMicro()), r.cacheTTL); if err != nil {
+		r.log.Err(err).Msg("")
+	}
+	r.notFound.Del(s2b(d.OrderUid))
+	r.rememberOrder(d.OrderUid)
+}
+
+// checkDuplicate сравнивает ордер d с уже сохраненным под тем же order_uid.
+func (r *Repo) checkDuplicate(d *Order) error {
+	var entity []byte
+	const sql = `SELECT entity FROM trade WHERE pk = $1;`
+	err := r.db.QueryRow(context.Background(), sql, d.OrderUid).Scan(&entity); if err != nil {
+		return err
+	}
+	return r.compareDuplicate(d, entity)
+}
+
+// compareDuplicate сравнивает ордер d с содержимым entity, сохраненным под тем же order_uid.
+func (r *Repo) compareDuplicate(d *Order, entity []byte) error {
+	var existing Order
+	err := json.Unmarshal(entity, &existing); if err != nil {
+		return err
+	}
+
+	diffs := diffOrders(&existing, d)
+	if len(diffs) == 0 {
+		atomic.AddUint64(&r.orderDuplicates, 1)
+		return nil
+	}
+	atomic.AddUint64(&r.orderConflicts, 1)
+	return &ConflictError{OrderUid: d.OrderUid, Fields: diffs}
+}
+
+// InvalidateOrders удаляет ордера из кеша этого и других экземпляров
+// и возвращает, сколько из них было в кеше этого экземпляра.
+func (r *Repo) InvalidateOrders(uids []string) int {
+	keys := make([][]byte, 0, len(uids))
+	for _, uid := range uids {
+		keys = append(keys, s2b(uid))
+	}
+	n := r.cache.DelMany(keys)
+	for _, uid := range uids {
+		err := r.notifyInvalidation(uid); if err != nil {
+			r.log.Err(err).Msg("")
+		}
+	}
+	return n
+}
+
+// GetOrderByUid отдает ордер из кеша, а при промахе загружает его из db
+// и кладет в кеш. Конкурентные промахи по одному uid делают один запрос в db.
+//
+// Если uid точно нет в фильтре Блума или он недавно не нашелся в db,
+// сразу возвращается ErrOrderNotFound.
 func (r *Repo) GetOrderByUid(uid string) ([]byte, error) {
-    b, ok := r.cache.HasGet(nil, s2b(uid)); if ok {
-        return b, nil
+	if !r.orderKnown(uid) || r.notFound.Has(s2b(uid)) {
+		return nil, ErrOrderNotFound
 	}
+	return r.cache.GetOrLoad(nil, s2b(uid), r.loadOrder)
+}
 
+func (r *Repo) loadOrder(uid []byte) ([]byte, time.Duration, error) {
 	var order any
 	const sql = `SELECT entity FROM trade WHERE pk = $1;`
-    err := r.db.QueryRow(context.Background(), sql, uid).Scan(&order); if err != nil {
-		return nil, err
+    err := r.db.QueryRow(context.Background(), sql, string(uid)).Scan(&order); if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			_ = r.notFound.SetWithTTL(uid, nil, r.notFoundTTL)
+			return nil, 0, ErrOrderNotFound
+		}
+		return nil, 0, err
 	}
-	
-	b, _ = json.Marshal(order)
-    return b, nil
+
+	b, _ := json.Marshal(order)
+    return b, r.cacheTTL, nil
 }
 
+// GetOrderList отдает ссылки на последние count ордеров.
+// Ответ кешируется на orderListTTL.
 func (r *Repo) GetOrderList(count int) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], uint64(count))
+	b, ok := r.orderList.HasGet(nil, key[:]); if ok {
+		return b
+	}
+
 	const sql = `SELECT pk, rang FROM trade ORDER BY rang DESC LIMIT $1;`
     rows, err := r.db.Query(context.Background(), sql, count); if err != nil {
 		r.log.Err(err).Msg("")
@@ -108,19 +338,59 @@ func (r *Repo) GetOrderList(count int) []byte {
 		entities = append(entities, entity)
 	}
 
-	b, _ := json.Marshal(entities)
+	b, _ = json.Marshal(entities)
+	if rows.Err() != nil {
+		return b
+	}
+	err = r.orderList.SetWithTTL(key[:], b, r.orderListTTL); if err != nil {
+		r.log.Err(err).Msg("")
+	}
+    return b
+}
+
+// CachedOrderUids возвращает uid всех ордеров, которые сейчас лежат в кеше.
+func (r *Repo) CachedOrderUids() []byte {
+	uids := make([]string, 0)
+	r.cache.VisitKeys(func(k []byte) bool {
+		uids = append(uids, string(k))
+		return true
+	})
+
+	b, _ := json.Marshal(uids)
     return b
 }
 
-func (r *Repo) Metric() []byte {
+// Metric отдает метрики сервиса. С detailed добавляется статистика
+// каждого bucket кеша и горячие ключи.
+func (r *Repo) Metric(detailed bool) []byte {
 	var m Monitor 
 	r.cache.UpdateStats(&m.Cache)
+	m.CacheHitRatio = m.Cache.HitRatio()
+	if detailed {
+		m.CacheDetails = &cache.DetailedStats{}
+		r.cache.UpdateDetailedStats(m.CacheDetails, hotKeysTop)
+	}
+	r.notFound.UpdateStats(&m.NotFoundCache)
+	r.orderList.UpdateStats(&m.OrderListCache)
+	m.InvalidationsReceived = atomic.LoadUint64(&r.invalidationsReceived)
+	m.OrderDuplicates = atomic.LoadUint64(&r.orderDuplicates)
+	m.OrderConflicts = atomic.LoadUint64(&r.orderConflicts)
+	m.BloomReady = r.bloomReady()
+	m.BloomRejects = atomic.LoadUint64(&r.bloomRejects)
+	if r.batch != nil {
+		m.DbBatches = atomic.LoadUint64(&r.batch.batches)
+		m.DbBatchedOrders = atomic.LoadUint64(&r.batch.orders)
+	}
 
 
 	const sql = `SELECT count(pk) FROM trade;`
     err := r.db.QueryRow(context.Background(), sql).Scan(&m.DatabaseOrderCount); if err != nil {
 		r.log.Err(err).Msg("")
 	}
+	const sqlDeadLetters = `SELECT count(id) FROM trade_dead_letter WHERE redriven_at IS NULL;`
+	err = r.db.QueryRow(context.Background(), sqlDeadLetters).Scan(&m.DeadLetterCount); if err != nil {
+		r.log.Err(err).Msg("")
+	}
 
     mb, _ := json.Marshal(m)
     return mb
@@ -128,14 +398,14 @@ func (r *Repo) Metric() []byte {
 
 func (r *Repo) cacheWarmUp() {
 	const sql = `SELECT pk, rang, entity FROM trade ORDER BY rang DESC LIMIT $1;`
-    rows, err := r.db.Query(context.Background(), sql, initCacheCount); if err != nil {
+    rows, err := r.db.Query(context.Background(), sql, r.warmUpCount); if err != nil {
 		r.log.Err(err).Msg("db error")
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		rowValues := rows.RawValues()
-		err := r.cache.Set(rowValues[0], rowValues[2]); if err != nil {
+		err := r.cache.SetWithTTL(rowValues[0], rowValues[2], r.cacheTTL); if err != nil {
 			r.log.Err(err).Msg("")
 		}
 	}
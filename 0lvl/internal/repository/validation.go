@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// orderUidMaxLen длина колонки trade.pk.
+const orderUidMaxLen = 32
+
+// ErrInvalidOrder — общая причина всех ошибок валидации ордера,
+// проверяется через errors.Is.
+var ErrInvalidOrder = errors.New("invalid order")
+
+// Правила валидации в FieldError.Rule.
+const (
+	RuleRequired = "required"
+	RuleTooLong  = "too_long"
+	RuleNegative = "negative"
+	RuleMismatch = "mismatch"
+	RuleFormat   = "format"
+)
+
+// FieldError — нарушение одного правила в одном поле ордера.
+type FieldError struct {
+	// Field — путь к полю в JSON ордера, например "items[1].track_number".
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError содержит все нарушения, найденные в ордере.
+type ValidationError struct {
+	OrderUid string       `json:"order_uid"`
+	Fields   []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Error())
+	}
+	return fmt.Sprintf("invalid order %q: %s", e.OrderUid, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidOrder
+}
+
+func (e *ValidationError) add(field, rule, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) required(field, value string) {
+	if value == "" {
+		e.add(field, RuleRequired, "must not be empty")
+	}
+}
+
+func (e *ValidationError) notNegative(field string, value int) {
+	if value < 0 {
+		e.add(field, RuleNegative, "must not be negative; got %d", value)
+	}
+}
+
+// Validate проверяет структуру ордера и бизнес-правила:
+// обязательные поля, неотрицательные суммы, совпадение track_number
+// у ордера и всех товаров и равенство goods_total сумме total_price товаров.
+// Возвращает *ValidationError со всеми нарушениями или nil.
+func (o *Order) Validate() error {
+	e := &ValidationError{OrderUid: o.OrderUid}
+
+	e.required("order_uid", o.OrderUid)
+	if len(o.OrderUid) > orderUidMaxLen {
+		e.add("order_uid", RuleTooLong, "must be at most %d bytes; got %d", orderUidMaxLen, len(o.OrderUid))
+	}
+	e.required("track_number", o.TrackNumber)
+	e.required("entry", o.Entry)
+	if o.DateCreated.IsZero() {
+		e.add("date_created", RuleRequired, "must be set")
+	}
+
+	e.required("delivery.name", o.Delivery.Name)
+	e.required("delivery.address", o.Delivery.Address)
+	if o.Delivery.Email != "" && !strings.Contains(o.Delivery.Email, "@") {
+		e.add("delivery.email", RuleFormat, "must be an email address")
+	}
+
+	p := &o.Payment
+	e.required("payment.transaction", p.Transaction)
+	e.required("payment.currency", p.Currency)
+	e.notNegative("payment.amount", p.Amount)
+	e.notNegative("payment.delivery_cost", p.DeliveryCost)
+	e.notNegative("payment.goods_total", p.GoodsTotal)
+	e.notNegative("payment.custom_fee", p.CustomFee)
+
+	if len(o.Items) == 0 {
+		e.add("items", RuleRequired, "must contain at least one item")
+	}
+	goodsTotal := 0
+	for i, item := range o.Items {
+		field := fmt.Sprintf("items[%d].", i)
+		if item.TrackNumber != o.TrackNumber {
+			e.add(field+"track_number", RuleMismatch, "must equal order track_number %q; got %q", o.TrackNumber, item.TrackNumber)
+		}
+		e.notNegative(field+"price", item.Price)
+		e.notNegative(field+"total_price", item.TotalPrice)
+		if item.Sale < 0 || item.Sale > 100 {
+			e.add(field+"sale", RuleFormat, "must be a percentage in [0, 100]; got %d", item.Sale)
+		}
+		goodsTotal += item.TotalPrice
+	}
+	if len(o.Items) > 0 && p.GoodsTotal != goodsTotal {
+		e.add("payment.goods_total", RuleMismatch, "must equal sum of items total_price %d; got %d", goodsTotal, p.GoodsTotal)
+	}
+
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
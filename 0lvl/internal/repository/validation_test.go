@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testOrder возвращает ордер, проходящий Validate.
+func testOrder() *Order {
+	return &Order{
+		OrderUid: "b563feb7b2b84b6test",
+		TrackNumber: "WBILMTESTTRACK",
+		Entry: "WBIL",
+		Delivery: Delivery{
+			Name: "Test Testov",
+			Address: "Ploshad Mira 15",
+			Email: "test@gmail.com",
+		},
+		Payment: Payment{
+			Transaction: "b563feb7b2b84b6test",
+			Currency: "USD",
+			Amount: 1817,
+			DeliveryCost: 1500,
+			GoodsTotal: 317,
+		},
+		Items: []Item{
+			{ChrtId: 9934930, TrackNumber: "WBILMTESTTRACK", Price: 453, Sale: 30, TotalPrice: 217},
+			{ChrtId: 9934931, TrackNumber: "WBILMTESTTRACK", Price: 100, TotalPrice: 100},
+		},
+		DateCreated: time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC),
+	}
+}
+
+func TestOrderValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *Order)
+		want   []FieldError
+	}{
+		{
+			name: "valid",
+			change: func(o *Order) {},
+		},
+		{
+			name: "empty uid",
+			change: func(o *Order) { o.OrderUid = "" },
+			want: []FieldError{{Field: "order_uid", Rule: RuleRequired}},
+		},
+		{
+			name: "long uid",
+			change: func(o *Order) { o.OrderUid = "0123456789abcdef0123456789abcdef0" },
+			want: []FieldError{{Field: "order_uid", Rule: RuleTooLong}},
+		},
+		{
+			name: "negative amounts",
+			change: func(o *Order) {
+				o.Payment.Amount = -1
+				o.Payment.DeliveryCost = -1
+				o.Items[1].Price = -1
+			},
+			want: []FieldError{
+				{Field: "payment.amount", Rule: RuleNegative},
+				{Field: "payment.delivery_cost", Rule: RuleNegative},
+				{Field: "items[1].price", Rule: RuleNegative},
+			},
+		},
+		{
+			name: "track_number mismatch",
+			change: func(o *Order) { o.Items[0].TrackNumber = "OTHER" },
+			want: []FieldError{{Field: "items[0].track_number", Rule: RuleMismatch}},
+		},
+		{
+			name: "goods_total not sum of items",
+			change: func(o *Order) { o.Payment.GoodsTotal = 318 },
+			want: []FieldError{{Field: "payment.goods_total", Rule: RuleMismatch}},
+		},
+		{
+			name: "no items",
+			change: func(o *Order) { o.Items = nil },
+			want: []FieldError{{Field: "items", Rule: RuleRequired}},
+		},
+		{
+			name: "bad email and sale",
+			change: func(o *Order) {
+				o.Delivery.Email = "test"
+				o.Items[0].Sale = 101
+			},
+			want: []FieldError{
+				{Field: "delivery.email", Rule: RuleFormat},
+				{Field: "items[0].sale", Rule: RuleFormat},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOrder()
+			tt.change(o)
+			err := o.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %s", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidOrder) {
+				t.Fatalf("Validate: %v; want ErrInvalidOrder", err)
+			}
+			var ve *ValidationError
+			if !errors.As(err, &ve) || ve.OrderUid != o.OrderUid {
+				t.Fatalf("Validate: %#v; want *ValidationError for %q", err, o.OrderUid)
+			}
+			if len(ve.Fields) != len(tt.want) {
+				t.Fatalf("Validate: %s; want %d field errors", err, len(tt.want))
+			}
+			for i, f := range ve.Fields {
+				if f.Field != tt.want[i].Field || f.Rule != tt.want[i].Rule || f.Message == "" {
+					t.Fatalf("field error %d: %+v; want %s %s", i, f, tt.want[i].Field, tt.want[i].Rule)
+				}
+			}
+		})
+	}
+}
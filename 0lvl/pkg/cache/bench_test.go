@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Бенчмарки сравнивают Cache с map[string][]byte под RWMutex и с sync.Map
+// на одной нагрузке: benchItemsCount ключей, которые пишутся и читаются
+// из GOMAXPROCS горутин. SetBytes считает операции, а не байты.
+
+const benchItemsCount = 1 << 16
+
+var benchValue = []byte("xyza-value-of-about-thirty-two-b")
+
+// benchSink не дает компилятору выбросить чтения в бенчмарках.
+var benchSink uint64
+
+func benchKeys() [][]byte {
+	keys := make([][]byte, benchItemsCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key %d", i))
+	}
+	return keys
+}
+
+// benchStore — общий интерфейс сравниваемых хранилищ.
+type benchStore interface {
+	set(k, v []byte)
+	get(dst, k []byte) []byte
+}
+
+type cacheStore struct{ c *Cache }
+
+func (s cacheStore) set(k, v []byte)          { _ = s.c.Set(k, v) }
+func (s cacheStore) get(dst, k []byte) []byte { return s.c.Get(dst, k) }
+
+type mapStore struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+func (s *mapStore) set(k, v []byte) {
+	s.mu.Lock()
+	s.m[string(k)] = v
+	s.mu.Unlock()
+}
+
+func (s *mapStore) get(dst, k []byte) []byte {
+	s.mu.RLock()
+	v := s.m[string(k)]
+	s.mu.RUnlock()
+	return append(dst, v...)
+}
+
+type syncMapStore struct{ m sync.Map }
+
+func (s *syncMapStore) set(k, v []byte) { s.m.Store(string(k), v) }
+
+func (s *syncMapStore) get(dst, k []byte) []byte {
+	v, ok := s.m.Load(string(k))
+	if !ok {
+		return dst
+	}
+	return append(dst, v.([]byte)...)
+}
+
+func benchStores(b *testing.B, f func(b *testing.B, s benchStore)) {
+	b.Run("Cache", func(b *testing.B) {
+		c, err := New(128 * 1024 * 1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close()
+		f(b, cacheStore{c})
+	})
+	b.Run("StdMap", func(b *testing.B) {
+		f(b, &mapStore{m: make(map[string][]byte)})
+	})
+	b.Run("SyncMap", func(b *testing.B) {
+		f(b, &syncMapStore{})
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	benchStores(b, func(b *testing.B, s benchStore) {
+		keys := benchKeys()
+		b.ReportAllocs()
+		b.SetBytes(benchItemsCount)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for _, k := range keys {
+					s.set(k, benchValue)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchStores(b, func(b *testing.B, s benchStore) {
+		keys := benchKeys()
+		for _, k := range keys {
+			s.set(k, benchValue)
+		}
+		b.ReportAllocs()
+		b.SetBytes(benchItemsCount)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			var buf []byte
+			n := 0
+			for pb.Next() {
+				for _, k := range keys {
+					buf = s.get(buf[:0], k)
+					n += len(buf)
+				}
+			}
+			atomic.AddUint64(&benchSink, uint64(n))
+		})
+	})
+}
+
+func BenchmarkSetGet(b *testing.B) {
+	benchStores(b, func(b *testing.B, s benchStore) {
+		keys := benchKeys()
+		b.ReportAllocs()
+		b.SetBytes(2 * benchItemsCount)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			var buf []byte
+			n := 0
+			for pb.Next() {
+				for _, k := range keys {
+					s.set(k, benchValue)
+				}
+				for _, k := range keys {
+					buf = s.get(buf[:0], k)
+					n += len(buf)
+				}
+			}
+			atomic.AddUint64(&benchSink, uint64(n))
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// maxSubvalueLen возвращает максимальную длину части большого значения.
+// Часть вместе с заголовком и ключом части должна влезать в один chunk.
+func (c *Cache) maxSubvalueLen() int {
+	return int(c.chunkSize) - entryHeaderSize - bigSubkeyLen - 1
+}
+
+// maxKeyLen возвращает максимальную длину ключа, который принимает Set.
+func (c *Cache) maxKeyLen() int {
+	return c.maxSubvalueLen()
+}
+
+// bigSubkeyLen длина ключа части: хеш значения (8 байт) и номер части (8 байт).
+const bigSubkeyLen = 16
+
+// bigMetaLen длина метаданных большого значения: хеш значения и его длина.
+const bigMetaLen = 16
+
+// setBig сохраняет значение, которое не влезает в один chunk.
+//
+// Значение режется на части по c.maxSubvalueLen(). Каждая часть хранится под ключом
+// (хеш значения, номер части) с флагом flagBigPart, а под ключом k сохраняется
+// мета-запись с флагом flagBigMeta: хеш и длина всего значения.
+// Срок жизни expireAt и флаги сжатия flags хранятся только в мета-записи.
+// Одинаковые значения разных ключей делят одни и те же части.
+//
+// Мета-запись пишется последней, поэтому конкурентный Get по ключу k видит
+// либо предыдущее значение, либо новое целиком.
+func (c *Cache) setBig(k, v []byte, flags byte, expireAt uint64) error {
+	meta, err := c.setBigParts(v); if err != nil {
+		return err
+	}
+	return c.set(k, meta[:], flags|flagBigMeta, expireAt)
+}
+
+// setBigParts сохраняет части значения v и возвращает мета-запись для него.
+func (c *Cache) setBigParts(v []byte) ([bigMetaLen]byte, error) {
+	var meta [bigMetaLen]byte
+	valueHash := xxhash.Sum64(v)
+	valueLen := uint64(len(v))
+	var subkey [bigSubkeyLen]byte
+	binary.BigEndian.PutUint64(subkey[:8], valueHash)
+
+	maxSubvalueLen := c.maxSubvalueLen()
+	i := uint64(0)
+	for len(v) > 0 {
+		subvalueLen := maxSubvalueLen
+		if len(v) < subvalueLen {
+			subvalueLen = len(v)
+		}
+		binary.BigEndian.PutUint64(subkey[8:], i)
+		err := c.set(subkey[:], v[:subvalueLen], flagBigPart, 0); if err != nil {
+			return meta, err
+		}
+		v = v[subvalueLen:]
+		i++
+	}
+
+	binary.BigEndian.PutUint64(meta[:8], valueHash)
+	binary.BigEndian.PutUint64(meta[8:], valueLen)
+	return meta, nil
+}
+
+// getBig собирает большое значение по мета-записи meta из bucket b и добавляет его в dst.
+//
+// Если какая-то часть вытеснена или собранное значение не совпадает
+// с хешем из меты, возвращается исходный dst и false.
+// С peek части читаются через bucket.Peek, без статистики.
+func (c *Cache) getBig(b *bucket, dst, meta []byte, peek bool) ([]byte, bool) {
+	if len(meta) != bigMetaLen {
+		return dst, false
+	}
+	valueHash := binary.BigEndian.Uint64(meta[:8])
+	valueLen := binary.BigEndian.Uint64(meta[8:])
+
+	dstLen := len(dst)
+	var subkey [bigSubkeyLen]byte
+	binary.BigEndian.PutUint64(subkey[:8], valueHash)
+	maxSubvalueLen := uint64(c.maxSubvalueLen())
+	subkeysCount := (valueLen + maxSubvalueLen - 1) / maxSubvalueLen
+	for i := uint64(0); i < subkeysCount; i++ {
+		binary.BigEndian.PutUint64(subkey[8:], i)
+		h := xxhash.Sum64(subkey[:])
+		var flags byte
+		var ok bool
+		if peek {
+			dst, flags, ok = c.bucket(h).Peek(dst, subkey[:], h)
+		} else {
+			dst, flags, _, ok = c.bucket(h).Get(dst, subkey[:], h, true)
+		}
+		if !ok || flags&flagBigPart == 0 {
+			return dst[:dstLen], false
+		}
+	}
+
+	v := dst[dstLen:]
+	if uint64(len(v)) != valueLen || xxhash.Sum64(v) != valueHash {
+		// Часть перезаписана значением с тем же ключом части,
+		// либо данные в chunk испорчены.
+		atomic.AddUint64(&b.corruptions, 1)
+		return dst[:dstLen], false
+	}
+	return dst, true
+}
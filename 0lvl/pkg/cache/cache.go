@@ -5,19 +5,32 @@ package cache
 //https://github.com/VictoriaMetrics/fastcache
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
-
+	
 	"golang.org/x/sys/unix"
 	xxhash "github.com/cespare/xxhash/v2"
 )
 
 
-const bucketsCount = 512
+// defaultBucketsCount количество bucket, если Options.BucketsCount не задан.
+const defaultBucketsCount = 512
+
+// defaultChunkSize размер chunk, если Options.ChunkSize не задан.
+// Это же максимальный размер chunk: длины ключа и значения кодируются 2 байтами.
+const defaultChunkSize = 64 * 1024
+
+// minChunkSize минимальный размер chunk, в который влезает часть большого значения.
+const minChunkSize = 1024
 
-const chunkSize = 64 * 1024
+// defaultChunksPerAlloc количество chunks, выделяемых одним mmap,
+// если Options.ChunksPerAlloc не задан.
+const defaultChunksPerAlloc = 1024
 
 const bucketSizeBits = 40
 
@@ -27,6 +40,29 @@ const maxGen = 1<<genSizeBits - 1
 
 const maxBucketSize uint64 = 1 << bucketSizeBits
 
+// entryHeaderSize размер заголовка записи в chunk:
+// длина ключа (2 байта), длина значения (2 байта), флаги (1 байт),
+// время истечения в наносекундах unix (8 байт, 0 — без срока)
+// и версия значения (8 байт, 0 — без версии, см. SetIfNewer).
+const entryHeaderSize = 21
+
+const (
+	// flagBigMeta — запись хранит метаданные большого значения, см. setBig.
+	flagBigMeta byte = 1 << iota
+
+	// flagBigPart — запись хранит часть большого значения.
+	// Такие записи не видны через Get/Has по ключу пользователя.
+	flagBigPart
+
+	// flagS2 и flagZstd — значение сжато соответствующим кодеком.
+	// У большого значения флаг стоит на мета-записи, а сжато значение целиком.
+	flagS2
+	flagZstd
+)
+
+// flagsCompressed все флаги сжатия.
+const flagsCompressed = flagS2 | flagZstd
+
 
 // Используйте Cache.UpdateStats для получения свежей статистики из кеша.
 type Stats struct {
@@ -36,6 +72,10 @@ type Stats struct {
     // Misses — количество промахов в кэше.
 	Misses uint64
 
+	// Expired — количество Get, попавших на запись с истекшим TTL.
+	// Такие обращения также учитываются в Misses.
+	Expired uint64
+
     // Collisions — количество коллизий кэша.
     //
     // Обычно количество коллизий должно быть близко к нулю.
@@ -43,15 +83,68 @@ type Stats struct {
 	Collisions uint64
 	Сorruptions uint64
 
+	// Loads — количество вызовов Loader в GetOrLoad.
+	Loads uint64
+
+	// LoadsShared — количество промахов GetOrLoad, которые дождались
+	// чужой загрузки вместо собственного вызова Loader.
+	LoadsShared uint64
+
+	// Policy — название политики вытеснения и допуска, см. Options.
+	// Нужно, чтобы сравнивать HitRatio кешей с разными политиками.
+	Policy string
+
+	// AdmissionRejects — количество Set и SetIfNewer, отклоненных допуском по частоте.
+	AdmissionRejects uint64
+
+	// Promotions — количество записей, переписанных в голову кольцевого
+	// буфера при попадании.
+	Promotions uint64
+
+	// VersionRejects — количество SetIfNewer, отклоненных из-за того,
+	// что в кеше уже лежит та же или более новая версия.
+	VersionRejects uint64
+
+	// Статистика второго уровня на диске, см. Options.DiskPath.
+	// DiskHits — промахи памяти, найденные на диске (в Misses они тоже учтены).
+	// DiskSpills — записи, вытесненные из памяти на диск,
+	// DiskDropped — вытесненные записи, отброшенные из-за отставания записи на диск.
+	DiskEntries uint64
+	DiskBytes   uint64
+	DiskHits    uint64
+	DiskSpills  uint64
+	DiskDropped uint64
+	DiskErrors  uint64
+
 	EntriesCount uint64
 	AllocBytes uint64
 	MaxBytes uint64
+
+	// MappedBytes — память вне кучи, выделенная через mmap.
+	MappedBytes uint64
+
+	// InUseBytes — часть MappedBytes, занятая chunks bucket.
+	// Остальное лежит в пуле свободных chunks.
+	InUseBytes uint64
+
+	// RawBytes — суммарный размер сжатых значений до сжатия,
+	// CompressedBytes — после. Считаются только значения, которые удалось сжать.
+	RawBytes        uint64
+	CompressedBytes uint64
 }
 
 func (s *Stats) Reset() {
 	*s = Stats{}
 }
 
+// HitRatio возвращает долю Get, которые нашли значение в кеше.
+func (s *Stats) HitRatio() float64 {
+	if s.GetCalls == 0 {
+		return 0
+	}
+	return float64(s.GetCalls-s.Misses) / float64(s.GetCalls)
+}
+
 // Кэш — это быстрый потокобезопасный кеш в памяти, оптимизированный для большого количества
 // записей.
 //
@@ -59,43 +152,234 @@ func (s *Stats) Reset() {
 //
 // Параллельные горутины могут вызывать любые методы Cache в одном и том же экземпляре Cache.
 //
-// Вызовите Reset, когда кеш больше не нужен. Это возвращает выделенную память.
+// Вызовите Close, когда кеш больше не нужен. Это возвращает выделенную память ОС.
 type Cache struct {
-	buckets [bucketsCount]bucket
+	buckets []bucket
+
+	chunkSize uint64
+	alloc     *chunkAllocator
+
+	// ownsAlloc — false у пространств имен, которые делят alloc с родителем.
+	ownsAlloc bool
+
+	namespaces namespaces
+
+	loads loadGroup
+
+	compressStats compressStats
+
+	// hotKeys сэмплирует Get для DetailedStats.HotKeys, nil если выключен.
+	hotKeys *hotKeySampler
+
+	// disk — второй уровень кеша, nil если выключен.
+	disk *diskTier
+
+	opts Options
+}
+
+// Options задает параметры кеша для NewWithOptions.
+type Options struct {
+	// MaxBytes — емкость кеша, см. New.
+	MaxBytes uint64
+
+	// BucketsCount — количество bucket, каждый со своей блокировкой.
+	// Больше bucket — меньше конкуренции за блокировки, но больше
+	// минимальная емкость: каждый bucket занимает хотя бы один chunk.
+	BucketsCount uint64
+
+	// ChunkSize — размер chunk кольцевого буфера, от 1 КБ до 64 КБ.
+	// Запись вместе с ключом больше chunk хранится по частям.
+	ChunkSize uint64
+
+	// ChunksPerAlloc — сколько chunks выделять одним вызовом mmap.
+	ChunksPerAlloc uint64
+
+	// Compression — кодек, которым сжимаются значения при Set.
+	// Значение хранится сжатым, только если это уменьшает его размер.
+	Compression Compression
+
+	// HotKeysSampleRate включает учет горячих ключей для UpdateDetailedStats:
+	// учитывается каждый HotKeysSampleRate-й Get. 0 — учет выключен.
+	HotKeysSampleRate uint64
+
+	// AdmitMinFrequency включает допуск по частоте в духе TinyLFU.
+	// Когда bucket заполнен, новый ключ записывается, только если по оценке
+	// count-min sketch к нему обращались не меньше AdmitMinFrequency раз.
+	// Так всплеск новых записей, которые никто не читает, не вытесняет
+	// часто читаемые. 0 — допускать все записи (чистый FIFO).
+	AdmitMinFrequency uint8
+
+	// PromoteOnHit включает перезапись в голову кольцевого буфера записей,
+	// которые читают незадолго до их вытеснения.
+	PromoteOnHit bool
+
+	// DiskPath включает второй уровень кеша в каталоге DiskPath.
+	// Записи, вытесненные из памяти, дописываются туда, а промахи памяти
+	// ищутся на диске и возвращаются в память. Большие значения на диск не попадают.
+	// Записи на диске переживают Close и перезапуск процесса. "" — без второго уровня.
+	DiskPath string
+
+	// DiskMaxBytes — емкость второго уровня, по умолчанию 4 * MaxBytes.
+	DiskMaxBytes uint64
+
+	// NamespaceBytes — сколько из MaxBytes будет вырезано под квоты пространств имен.
+	// Вырезать можно только из bucket, где больше одного chunk, поэтому, если
+	// BucketsCount не задан, bucket берется меньше, чтобы квоты поместились
+	// в MaxBytes. Емкость самого кеша уменьшается на вырезанное.
+	NamespaceBytes uint64
+}
+
+// policyName возвращает название политики для Stats.Policy.
+func (o *Options) policyName() string {
+	name := "fifo"
+	if o.AdmitMinFrequency > 0 {
+		name += "+tinylfu"
+	}
+	if o.PromoteOnHit {
+		name += "+promote"
+	}
+	return name
 }
 
 // Если maxBytes меньше 32 МБ, то минимальная емкость кэша составляет 32 МБ.
 func New(maxBytes uint64) (*Cache, error) {
-	if maxBytes <= 0 {
-		return nil, fmt.Errorf("maxBytes must be greater than 0; got %d", maxBytes)
+	return NewWithOptions(Options{MaxBytes: maxBytes})
+}
+
+// NewWithOptions создает кеш с параметрами opts.
+// Незаданные BucketsCount, ChunkSize и ChunksPerAlloc берутся по умолчанию:
+// 512 bucket по chunks в 64 КБ, выделяемых по 1024 за раз.
+// Минимальная емкость кеша — BucketsCount * ChunkSize.
+func NewWithOptions(opts Options) (*Cache, error) {
+	if opts.MaxBytes <= 0 {
+		return nil, fmt.Errorf("maxBytes must be greater than 0; got %d", opts.MaxBytes)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.BucketsCount == 0 {
+		opts.BucketsCount = carvableBucketsCount(opts.MaxBytes, opts.ChunkSize, opts.NamespaceBytes)
+	}
+	if opts.ChunksPerAlloc == 0 {
+		opts.ChunksPerAlloc = defaultChunksPerAlloc
+	}
+	if opts.DiskMaxBytes == 0 {
+		opts.DiskMaxBytes = 4 * opts.MaxBytes
+	}
+	if opts.Compression > CompressionZstd {
+		return nil, fmt.Errorf("unknown compression %d", opts.Compression)
+	}
+	if opts.ChunkSize < minChunkSize || opts.ChunkSize > defaultChunkSize {
+		return nil, fmt.Errorf("chunkSize must be in range [%d, %d]; got %d", minChunkSize, defaultChunkSize, opts.ChunkSize)
+	}
+
+	c, err := newCache(opts, &chunkAllocator{
+		chunkSize: opts.ChunkSize,
+		chunksPerAlloc: opts.ChunksPerAlloc,
+	}); if err != nil {
+		return nil, err
+	}
+	c.ownsAlloc = true
+	return c, nil
+}
+
+// carvableBucketsCount возвращает количество bucket по умолчанию, уменьшенное вдвое
+// столько раз, сколько нужно, чтобы из кеша на maxBytes можно было вырезать
+// namespaceBytes, оставив каждому bucket хотя бы один chunk.
+func carvableBucketsCount(maxBytes, chunkSize, namespaceBytes uint64) uint64 {
+	buckets := uint64(defaultBucketsCount)
+	if namespaceBytes == 0 {
+		return buckets
 	}
-	var c Cache
-	maxBucketBytes := uint64((maxBytes + bucketsCount - 1) / bucketsCount)
-	for i := range c.buckets[:] {
-		err := c.buckets[i].Init(maxBucketBytes); if err != nil {
+	chunks := maxBytes / chunkSize
+	need := (namespaceBytes + chunkSize - 1) / chunkSize
+	for buckets > 1 {
+		perBucket := chunks / buckets
+		if perBucket > 1 && buckets*(perBucket-1) >= need {
+			break
+		}
+		buckets /= 2
+	}
+	return buckets
+}
+
+// newCache создает кеш по проверенным opts, который берет chunks из alloc.
+func newCache(opts Options, alloc *chunkAllocator) (*Cache, error) {
+	c := Cache{
+		buckets: make([]bucket, opts.BucketsCount),
+		chunkSize: opts.ChunkSize,
+		alloc: alloc,
+		opts: opts,
+	}
+	if opts.HotKeysSampleRate > 0 {
+		c.hotKeys = newHotKeySampler(opts.HotKeysSampleRate)
+	}
+	maxBucketBytes := uint64((opts.MaxBytes + opts.BucketsCount - 1) / opts.BucketsCount)
+	for i := range c.buckets {
+		err := c.buckets[i].Init(maxBucketBytes, c.alloc, &opts); if err != nil {
+			return nil, err
+		}
+	}
+	if opts.DiskPath != "" {
+		disk, err := openDiskTier(opts.DiskPath, opts.DiskMaxBytes); if err != nil {
 			return nil, err
 		}
+		c.disk = disk
+		for i := range c.buckets {
+			c.buckets[i].disk = disk
+		}
 	}
 	return &c, nil
 }
 
+func (c *Cache) bucket(h uint64) *bucket {
+	return &c.buckets[h%uint64(len(c.buckets))]
+}
+
 // Сохраненная запись может быть удалена в любой момент либо из-за 
 // переполнения кэша или из-за маловероятной коллизии хешей.
 //
-// (k, v) записи, общий размер которых превышает 64 КБ, не сохраняются в кеше.
+// Значения, которые вместе с ключом не влезают в один chunk (по умолчанию 64 КБ),
+// разбиваются на части прозрачно для вызывающего, см. setBig.
+// Ключ длиннее c.maxKeyLen() не сохраняется.
 func (c *Cache) Set(k, v []byte) error {
+	return c.SetWithTTL(k, v, 0)
+}
+
+// SetWithTTL работает как Set, но запись перестает возвращаться
+// из Get/HasGet/Has по истечении ttl. Место в chunks освобождается
+// как обычно — при перезаписи кольцевого буфера.
+//
+// ttl <= 0 означает запись без срока.
+func (c *Cache) SetWithTTL(k, v []byte, ttl time.Duration) error {
+	if len(k) > c.maxKeyLen() {
+		return fmt.Errorf("key too long: %d; max %d", len(k), c.maxKeyLen())
+	}
+	h := xxhash.Sum64(k)
+	if !c.bucket(h).Admit(h) {
+		return nil
+	}
+	var expireAt uint64
+	if ttl > 0 {
+		expireAt = uint64(time.Now().Add(ttl).UnixNano())
+	}
+	v, flags := c.compress(v)
+	if uint64(entryHeaderSize+len(k)+len(v)) >= c.chunkSize {
+		return c.setBig(k, v, flags, expireAt)
+	}
+	return c.set(k, v, flags, expireAt)
+}
+
+func (c *Cache) set(k, v []byte, flags byte, expireAt uint64) error {
 	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	return c.buckets[idx].Set(k, v, h)
+	return c.bucket(h).Set(k, v, h, flags, expireAt, 0)
 }
 
 // Get добавляет значение по ключу k в dst и возвращает результат.
 //
 // Get выделяет новый фрагмент байта для возвращаемого значения, если dst равен нулю.
 func (c *Cache) Get(dst, k []byte) []byte {
-	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	dst, _ = c.buckets[idx].Get(dst, k, h, true)
+	dst, _, _ = c.get(dst, k)
 	return dst
 }
 
@@ -103,40 +387,212 @@ func (c *Cache) Get(dst, k []byte) []byte {
 // Этот метод позволяет дифференцировать
 // сохраненное нулевое/пустое значение по сравнению с несуществующим значением.
 func (c *Cache) HasGet(dst, k []byte) ([]byte, bool) {
-	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	return c.buckets[idx].Get(dst, k, h, true)
+	dst, _, ok := c.get(dst, k)
+	return dst, ok
 }
 
 // Has возвращает true, если запись для данного ключа k существует в кеше.
+//
+// Обращение учитывается в статистике как один Get.
 func (c *Cache) Has(k []byte) bool {
 	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	_, ok := c.buckets[idx].Get(nil, k, h, false)
+	b := c.bucket(h)
+	_, flags, _, ok := b.Get(nil, k, h, false)
+	if !ok && c.disk != nil {
+		_, flags, _, ok = c.getDisk(b, nil, k, h)
+	}
+	if !ok || flags&flagBigPart != 0 {
+		return false
+	}
+	if flags&flagBigMeta != 0 {
+		// Большое значение есть, только если живы все его части.
+		_, ok = c.peek(nil, k)
+	}
 	return ok
 }
 
+// get возвращает значение по ключу k, добавленное в dst, и его версию.
+func (c *Cache) get(dst, k []byte) ([]byte, uint64, bool) {
+	if c.hotKeys != nil {
+		c.hotKeys.Sample(k)
+	}
+	h := xxhash.Sum64(k)
+	b := c.bucket(h)
+	dstLen := len(dst)
+	dst, flags, version, ok := b.Get(dst, k, h, true)
+	if !ok && c.disk != nil {
+		dst, flags, version, ok = c.getDisk(b, dst, k, h)
+	}
+	if !ok || flags&flagBigPart != 0 {
+		return dst[:dstLen], 0, false
+	}
+	dst, ok = c.decode(b, dst, dstLen, flags, false)
+	if !ok {
+		return dst, 0, false
+	}
+	return dst, version, true
+}
+
+// peek читает значение k из памяти как get, но не меняет статистику,
+// частоты ключей и позицию записи и не обращается ко второму уровню.
+func (c *Cache) peek(dst, k []byte) ([]byte, bool) {
+	h := xxhash.Sum64(k)
+	b := c.bucket(h)
+	dstLen := len(dst)
+	dst, flags, ok := b.Peek(dst, k, h)
+	if !ok || flags&flagBigPart != 0 {
+		return dst[:dstLen], false
+	}
+	return c.decode(b, dst, dstLen, flags, true)
+}
+
+// decode собирает большое значение и распаковывает сжатое.
+// dst[dstLen:] — сохраненное значение записи с флагами flags.
+func (c *Cache) decode(b *bucket, dst []byte, dstLen int, flags byte, peek bool) ([]byte, bool) {
+	var ok bool
+	if flags&flagBigMeta != 0 {
+		dst, ok = c.getBig(b, dst[:dstLen], dst[dstLen:], peek)
+		if !ok {
+			return dst, false
+		}
+	}
+	if flags&flagsCompressed != 0 {
+		dst, ok = c.decompress(dst, dstLen, flags)
+		if !ok {
+			atomic.AddUint64(&b.corruptions, 1)
+			return dst, false
+		}
+	}
+	return dst, true
+}
+
+// getDisk ищет ключ k во втором уровне и возвращает найденную запись в память.
+func (c *Cache) getDisk(b *bucket, dst, k []byte, h uint64) ([]byte, byte, uint64, bool) {
+	dst, e, ref, ok := c.disk.Get(dst, k, h)
+	if !ok {
+		return dst, 0, 0, false
+	}
+	b.SetFromDisk(k, h, e, ref)
+	return dst, e.flags, e.version, true
+}
+
 // Del удаляет значение для данного k из кеша.
-func (c *Cache) Del(k []byte) {
+//
+// Перед удалением ключ сверяется с сохраненным, поэтому при коллизии хешей
+// запись другого ключа не пострадает. Возвращает true, если была удалена
+// живая запись для k.
+func (c *Cache) Del(k []byte) bool {
 	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	c.buckets[idx].Del(h)
+	return c.bucket(h).Del(k, h)
+}
+
+// DelMany удаляет значения для всех keys и возвращает количество удаленных записей.
+func (c *Cache) DelMany(keys [][]byte) int {
+	n := 0
+	for _, k := range keys {
+		if c.Del(k) {
+			n++
+		}
+	}
+	return n
 }
 
 // Reset удаляет все элементы из кэша.
+//
+// Память пачек chunks, которые целиком освободились, возвращается ОС.
 func (c *Cache) Reset() {
-	for i := range c.buckets[:] {
+	for i := range c.buckets {
+		c.buckets[i].Reset()
+	}
+	if c.hotKeys != nil {
+		c.hotKeys.Reset()
+	}
+	if c.disk != nil {
+		c.disk.Reset()
+	}
+	_ = c.alloc.Trim()
+}
+
+// Close удаляет все элементы из кэша и возвращает ОС всю память chunks.
+// Пространства имен кеша закрываются, второй уровень дописывается на диск и выключается.
+// После Close кешем можно пользоваться как после Reset,
+// но память будет выделяться заново.
+func (c *Cache) Close() error {
+	c.closeNamespaces()
+	var diskErr error
+	if c.disk != nil {
+		diskErr = c.disk.Close()
+	}
+	for i := range c.buckets {
 		c.buckets[i].Reset()
 	}
+	return errors.Join(diskErr, c.alloc.Trim())
+}
+
+// Visit вызывает f для каждой живой записи кеша в памяти, пока f возвращает true.
+//
+// Записи, перезаписанные новым поколением кольцевого буфера, и записи
+// с истекшим TTL пропускаются. Большие значения передаются собранными целиком,
+// сжатые — распакованными.
+// k и v валидны только внутри вызова f, их нужно копировать.
+//
+// f вызывается под блокировкой bucket на чтение, поэтому не должна
+// вызывать методы этого же Cache. Записи, добавленные во время Visit,
+// могут как попасть, так и не попасть в обход.
+//
+// Visit не меняет статистику, частоты ключей и позиции записей
+// и не читает второй уровень. Если нужны только ключи, VisitKeys дешевле:
+// он не собирает большие значения и не распаковывает сжатые.
+func (c *Cache) Visit(f func(k, v []byte) bool) {
+	var deferred [][]byte
+	for i := range c.buckets {
+		var ok bool
+		deferred, ok = c.buckets[i].Visit(f, deferred[:0])
+		if !ok {
+			return
+		}
+		// Части больших значений лежат в других bucket, а распаковка
+		// не должна держать блокировку, поэтому такие записи читаем
+		// уже без блокировки текущего bucket.
+		for _, k := range deferred {
+			v, found := c.peek(nil, k)
+			if found && !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// VisitKeys вызывает f для ключа каждой живой записи кеша в памяти,
+// пока f возвращает true. Правила те же, что у Visit, но значения не читаются,
+// поэтому ключ большого значения передается без проверки его частей.
+// k валиден только внутри вызова f.
+func (c *Cache) VisitKeys(f func(k []byte) bool) {
+	for i := range c.buckets {
+		if !c.buckets[i].VisitKeys(f) {
+			return
+		}
+	}
 }
 
 // UpdateStats добавляет статистику кэша в s.
 //
 // Вызов s.Reset перед вызовом UpdateStats, если s используется повторно.
 func (c *Cache) UpdateStats(s *Stats) {
-	for i := range c.buckets[:] {
+	for i := range c.buckets {
 		c.buckets[i].UpdateStats(s)
 	}
+	s.Loads += atomic.LoadUint64(&c.loads.loads)
+	s.LoadsShared += atomic.LoadUint64(&c.loads.shared)
+	s.Policy = c.opts.policyName()
+	s.RawBytes += atomic.LoadUint64(&c.compressStats.rawBytes)
+	s.CompressedBytes += atomic.LoadUint64(&c.compressStats.compressedBytes)
+	if c.ownsAlloc {
+		c.alloc.UpdateStats(s)
+	}
+	if c.disk != nil {
+		c.disk.UpdateStats(s)
+	}
 }
 
 type bucket struct {
@@ -146,6 +602,10 @@ type bucket struct {
     // Он состоит из блоков по 64 КБ.
 	chunks [][]byte
 
+	// chunkSize размер chunk, alloc выделяет и забирает chunks.
+	chunkSize uint64
+	alloc     *chunkAllocator
+
 	// m сопоставляет hash(k) с idx пары (k, v) в chunks.
 	m map[uint64]uint64
 
@@ -158,20 +618,47 @@ type bucket struct {
 	getCalls    uint64
 	setCalls    uint64
 	misses      uint64
+	expired     uint64
 	collisions  uint64
 	corruptions uint64
+
+	// sketch считает частоту обращений к ключам для допуска, nil если допуск выключен.
+	sketch            *frequencySketch
+	admitMinFrequency uint8
+	admissionRejects  uint64
+
+	promoteOnHit bool
+	promotions   uint64
+
+	versionRejects uint64
+
+	// disk — второй уровень кеша, куда уходят вытесненные записи, nil если выключен.
+	disk     *diskTier
+	spillBuf []diskRecord
+
+	// Подробная статистика, изменяется под b.mu.
+	genWraps      uint64
+	cleanNanos    uint64
+	cleanMaxNanos uint64
 }
 
-func (b *bucket) Init(maxBytes uint64) error {
+func (b *bucket) Init(maxBytes uint64, alloc *chunkAllocator, opts *Options) error {
 	if maxBytes == 0 {
 		return fmt.Errorf("maxBytes cannot be zero")
 	}
 	if maxBytes >= maxBucketSize {
 		return fmt.Errorf("too big maxBytes=%d; should be smaller than %d", maxBytes, maxBucketSize)
 	}
-	maxChunks := (maxBytes + chunkSize - 1) / chunkSize
+	b.chunkSize = alloc.chunkSize
+	b.alloc = alloc
+	maxChunks := (maxBytes + b.chunkSize - 1) / b.chunkSize
 	b.chunks = make([][]byte, maxChunks)
 	b.m = make(map[uint64]uint64)
+	if opts.AdmitMinFrequency > 0 {
+		b.sketch = newFrequencySketch(maxBytes)
+		b.admitMinFrequency = opts.AdmitMinFrequency
+	}
+	b.promoteOnHit = opts.PromoteOnHit
 	b.Reset()
 	return nil
 }
@@ -180,7 +667,7 @@ func (b *bucket) Reset() {
 	b.mu.Lock()
 	chunks := b.chunks
 	for i := range chunks {
-		putChunk(chunks[i])
+		b.alloc.Put(chunks[i])
 		chunks[i] = nil
 	}
 	b.m = make(map[uint64]uint64)
@@ -189,8 +676,18 @@ func (b *bucket) Reset() {
 	atomic.StoreUint64(&b.getCalls, 0)
 	atomic.StoreUint64(&b.setCalls, 0)
 	atomic.StoreUint64(&b.misses, 0)
+	atomic.StoreUint64(&b.expired, 0)
 	atomic.StoreUint64(&b.collisions, 0)
 	atomic.StoreUint64(&b.corruptions, 0)
+	atomic.StoreUint64(&b.admissionRejects, 0)
+	atomic.StoreUint64(&b.promotions, 0)
+	atomic.StoreUint64(&b.versionRejects, 0)
+	b.genWraps = 0
+	b.cleanNanos = 0
+	b.cleanMaxNanos = 0
+	if b.sketch != nil {
+		b.sketch.Reset()
+	}
 	b.mu.Unlock()
 }
 
@@ -212,8 +709,12 @@ func (b *bucket) UpdateStats(s *Stats) {
 	s.GetCalls += atomic.LoadUint64(&b.getCalls)
 	s.SetCalls += atomic.LoadUint64(&b.setCalls)
 	s.Misses += atomic.LoadUint64(&b.misses)
+	s.Expired += atomic.LoadUint64(&b.expired)
 	s.Collisions += atomic.LoadUint64(&b.collisions)
 	s.Сorruptions += atomic.LoadUint64(&b.corruptions)
+	s.AdmissionRejects += atomic.LoadUint64(&b.admissionRejects)
+	s.Promotions += atomic.LoadUint64(&b.promotions)
+	s.VersionRejects += atomic.LoadUint64(&b.versionRejects)
 
 	b.mu.RLock()
 	s.EntriesCount += uint64(len(b.m))
@@ -222,35 +723,102 @@ func (b *bucket) UpdateStats(s *Stats) {
 		bytesSize += uint64(cap(chunk))
 	}
 	s.AllocBytes += bytesSize
-	s.MaxBytes += uint64(len(b.chunks)) * chunkSize
+	s.MaxBytes += uint64(len(b.chunks)) * b.chunkSize
 	b.mu.RUnlock()
 }
 
-func (b *bucket) Set(k, v []byte, h uint64) error {
+func (b *bucket) Set(k, v []byte, h uint64, flags byte, expireAt, version uint64) error {
+	atomic.AddUint64(&b.setCalls, 1)
+	err := b.checkLen(k, v); if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.setLocked(k, v, h, flags, expireAt, version)
+	b.mu.Unlock()
+	return nil
+}
+
+// SetFromDisk возвращает в память запись e ключа k, прочитанную с диска по ref.
+//
+// Диск читается без блокировки bucket, поэтому запись возвращается, только если
+// под блокировкой она все еще лежит на диске: иначе конкурентный Del или Set
+// уже убрал ее оттуда, и старая копия воскресила бы удаленный ключ
+// или затерла бы новую версию. Запись в память удаляет ключ с диска, см. setLocked.
+func (b *bucket) SetFromDisk(k []byte, h uint64, e entry, ref diskRef) {
+	if b.checkLen(k, e.value) != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.disk.Holds(h, ref) {
+		return
+	}
+	atomic.AddUint64(&b.setCalls, 1)
+	b.setLocked(k, e.value, h, e.flags, e.expireAt, e.version)
+}
+
+// SetIfNewer работает как Set, но не заменяет живую запись ключа k
+// с версией не меньше version. Возвращает, записано ли значение.
+func (b *bucket) SetIfNewer(k, v []byte, h uint64, flags byte, expireAt, version uint64) (bool, error) {
 	atomic.AddUint64(&b.setCalls, 1)
+	err := b.checkLen(k, v); if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.findLocked(h)
+	live := ok && string(e.key) == string(k) && !e.expired(uint64(time.Now().UnixNano()))
+	if live && e.version >= version {
+		atomic.AddUint64(&b.versionRejects, 1)
+		return false, nil
+	}
+	if b.sketch != nil && !b.frequent(h) && !live && !b.admitLocked(h) {
+		return false, nil
+	}
+	b.setLocked(k, v, h, flags, expireAt, version)
+	return true, nil
+}
+
+func (b *bucket) checkLen(k, v []byte) error {
 	if len(k) >= (1<<16) || len(v) >= (1<<16) {
         // Слишком большой ключ или значение — его длину невозможно закодировать
         // с 2 байтами (см. ниже). Пропустить запись.
 		return fmt.Errorf("set max len k or v")
 	}
-	var kvLenBuf [4]byte
+	kvLen := uint64(entryHeaderSize + len(k) + len(v))
+	if kvLen >= b.chunkSize {
+		return fmt.Errorf("chunk max %d bytes; len k and v: %d", b.chunkSize, kvLen)
+	}
+	return nil
+}
+
+// setLocked дописывает запись в голову кольцевого буфера.
+// Длины k и v уже проверены вызывающим, который держит b.mu.
+func (b *bucket) setLocked(k, v []byte, h uint64, flags byte, expireAt, version uint64) {
+	var kvLenBuf [entryHeaderSize]byte
 	kvLenBuf[0] = byte(uint16(len(k)) >> 8)
 	kvLenBuf[1] = byte(len(k))
 	kvLenBuf[2] = byte(uint16(len(v)) >> 8)
 	kvLenBuf[3] = byte(len(v))
+	kvLenBuf[4] = flags
+	binary.BigEndian.PutUint64(kvLenBuf[5:13], expireAt)
+	binary.BigEndian.PutUint64(kvLenBuf[13:], version)
 	kvLen := uint64(len(kvLenBuf) + len(k) + len(v))
-	if kvLen >= chunkSize {
-		return fmt.Errorf("chunk max 64KB; len k and v: %d", kvLen)
-	}
 
 	chunks := b.chunks
 	needClean := false
-	b.mu.Lock()
 	idx := b.idx
 	idxNew := idx + kvLen
-	chunkIdx := idx / chunkSize
-	chunkIdxNew := idxNew / chunkSize
+	chunkIdx := idx / b.chunkSize
+	chunkIdxNew := idxNew / b.chunkSize
 	if chunkIdxNew > chunkIdx {
+		if b.disk != nil {
+			if chunkIdxNew >= uint64(len(chunks)) {
+				b.spillLocked(0)
+			} else {
+				b.spillLocked(chunkIdxNew)
+			}
+		}
 		if chunkIdxNew >= uint64(len(chunks)) {
 			idx = 0
 			idxNew = kvLen
@@ -259,9 +827,10 @@ func (b *bucket) Set(k, v []byte, h uint64) error {
 			if b.gen&((1<<genSizeBits)-1) == 0 {
 				b.gen++
 			}
+			b.genWraps++
 			needClean = true
 		} else {
-			idx = chunkIdxNew * chunkSize
+			idx = chunkIdxNew * b.chunkSize
 			idxNew = idx + kvLen
 			chunkIdx = chunkIdxNew
 		}
@@ -269,7 +838,7 @@ func (b *bucket) Set(k, v []byte, h uint64) error {
 	}
 	chunk := chunks[chunkIdx]
 	if chunk == nil {
-		chunk = getChunk()
+		chunk = b.alloc.Get()
 		chunk = chunk[:0]
 	}
 	chunk = append(chunk, kvLenBuf[:]...)
@@ -278,110 +847,300 @@ func (b *bucket) Set(k, v []byte, h uint64) error {
 	chunks[chunkIdx] = chunk
 	b.m[h] = idx | (b.gen << bucketSizeBits)
 	b.idx = idxNew
+	// Новая запись в памяти заменяет копию ключа на диске,
+	// в том числе только что вытесненную.
+	if b.disk != nil {
+		b.disk.Forget(h)
+	}
 	if needClean {
-		b.cleanLocked()
+		b.cleanTimedLocked()
 	}
-	b.mu.Unlock()
-	return nil
 }
 
-func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
+func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, byte, uint64, bool) {
 	atomic.AddUint64(&b.getCalls, 1)
+	if b.sketch != nil {
+		b.sketch.Add(h)
+	}
 	found := false
-	chunks := b.chunks
+	promote := false
+	var flags byte
+	var version uint64
 	b.mu.RLock()
-	v := b.m[h]
-	bGen := b.gen & ((1 << genSizeBits) - 1)
-	if v > 0 {
-		gen := v >> bucketSizeBits
-		idx := v & ((1 << bucketSizeBits) - 1)
-		if gen == bGen && idx < b.idx || gen+1 == bGen && idx >= b.idx || gen == maxGen && bGen == 1 && idx >= b.idx {
-			chunkIdx := idx / chunkSize
-			if chunkIdx >= uint64(len(chunks)) {
-				// Corrupted data. Just skip it.
-				atomic.AddUint64(&b.corruptions, 1)
-				goto end
-			}
-			chunk := chunks[chunkIdx]
-			idx %= chunkSize
-			if idx+4 >= chunkSize {
-				// Corrupted data. Just skip it.
-				atomic.AddUint64(&b.corruptions, 1)
-				goto end
-			}
-			kvLenBuf := chunk[idx : idx+4]
-			keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
-			valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
-			idx += 4
-			if idx+keyLen+valLen >= chunkSize {
-				// Corrupted data. Just skip it.
-				atomic.AddUint64(&b.corruptions, 1)
-				goto end
-			}
-			// https://github.com/VictoriaMetrics/fastcache/issues/59
-			if string(k) == string(chunk[idx:idx+keyLen]) {
-				idx += keyLen
-				if returnDst {
-					dst = append(dst, chunk[idx:idx+valLen]...)
-				}
-				found = true
-			} else {
-				atomic.AddUint64(&b.collisions, 1)
+	e, ok := b.findLocked(h)
+	if ok {
+		// https://github.com/VictoriaMetrics/fastcache/issues/59
+		if string(k) != string(e.key) {
+			atomic.AddUint64(&b.collisions, 1)
+		} else if e.expired(uint64(time.Now().UnixNano())) {
+			atomic.AddUint64(&b.expired, 1)
+		} else {
+			if returnDst {
+				dst = append(dst, e.value...)
 			}
+			flags = e.flags
+			version = e.version
+			found = true
+			promote = b.promoteOnHit && b.isOldLocked(b.m[h])
 		}
 	}
-end:
 	b.mu.RUnlock()
 	if !found {
 		atomic.AddUint64(&b.misses, 1)
 	}
-	return dst, found
+	if promote {
+		b.Promote(k, h)
+	}
+	return dst, flags, version, found
+}
+
+// Peek ищет ключ k как Get, но не меняет статистику, частоты и позицию записи.
+func (b *bucket) Peek(dst, k []byte, h uint64) ([]byte, byte, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.findLocked(h)
+	if !ok || string(k) != string(e.key) || e.expired(uint64(time.Now().UnixNano())) {
+		return dst, 0, false
+	}
+	return append(dst, e.value...), e.flags, true
 }
 
-func (b *bucket) Del(h uint64) {
+// Del удаляет запись с ключом k, если она есть в bucket.
+// Возвращает true, если была удалена живая (не истекшая) запись.
+func (b *bucket) Del(k []byte, h uint64) bool {
+	deleted := false
 	b.mu.Lock()
-	delete(b.m, h)
+	e, ok := b.findLocked(h)
+	// При коллизии хешей под h лежит чужой ключ — его не трогаем.
+	if ok && string(k) == string(e.key) {
+		delete(b.m, h)
+		deleted = !e.expired(uint64(time.Now().UnixNano()))
+	}
+	if b.disk != nil && b.disk.Forget(h) {
+		deleted = true
+	}
 	b.mu.Unlock()
+	return deleted
 }
 
-const chunksPerAlloc = 1024
+// Visit вызывает f для живых записей bucket. Ключи больших и сжатых значений
+// не передаются в f, а копируются в deferred.
+// Возвращает false, если f попросила остановить обход.
+func (b *bucket) Visit(f func(k, v []byte) bool, deferred [][]byte) ([][]byte, bool) {
+	now := uint64(time.Now().UnixNano())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, v := range b.m {
+		e, ok := b.entryAtLocked(v)
+		if !ok || e.expired(now) || e.flags&flagBigPart != 0 {
+			continue
+		}
+		if e.flags&(flagBigMeta|flagsCompressed) != 0 {
+			deferred = append(deferred, append([]byte(nil), e.key...))
+			continue
+		}
+		if !f(e.key, e.value) {
+			return deferred, false
+		}
+	}
+	return deferred, true
+}
 
-var (
-	freeChunks     []*[chunkSize]byte
-	freeChunksLock sync.Mutex
-)
+// VisitKeys вызывает f для ключей живых записей bucket, кроме частей больших значений.
+// Возвращает false, если f попросила остановить обход.
+func (b *bucket) VisitKeys(f func(k []byte) bool) bool {
+	now := uint64(time.Now().UnixNano())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, v := range b.m {
+		e, ok := b.entryAtLocked(v)
+		if !ok || e.expired(now) || e.flags&flagBigPart != 0 {
+			continue
+		}
+		if !f(e.key) {
+			return false
+		}
+	}
+	return true
+}
+
+// entry — запись, раскодированная из chunk.
+// key и value ссылаются на память chunk и валидны только под b.mu.
+type entry struct {
+	key      []byte
+	value    []byte
+	flags    byte
+	expireAt uint64
+	version  uint64
+}
+
+func (e *entry) expired(now uint64) bool {
+	return e.expireAt != 0 && now >= e.expireAt
+}
+
+// findLocked возвращает запись, на которую указывает b.m[h], если она
+// не перезаписана новым поколением. Ключ не сверяется: при коллизии хешей
+// это запись другого ключа. Вызывающий держит b.mu.
+func (b *bucket) findLocked(h uint64) (entry, bool) {
+	v := b.m[h]
+	if v == 0 {
+		return entry{}, false
+	}
+	return b.entryAtLocked(v)
+}
+
+// entryAtLocked раскодирует запись по значению v из b.m.
+func (b *bucket) entryAtLocked(v uint64) (entry, bool) {
+	chunks := b.chunks
+	bGen := b.gen & ((1 << genSizeBits) - 1)
+	gen := v >> bucketSizeBits
+	idx := v & ((1 << bucketSizeBits) - 1)
+	if !(gen == bGen && idx < b.idx || gen+1 == bGen && idx >= b.idx || gen == maxGen && bGen == 1 && idx >= b.idx) {
+		return entry{}, false
+	}
+	chunkIdx := idx / b.chunkSize
+	if chunkIdx >= uint64(len(chunks)) {
+		// Corrupted data. Just skip it.
+		atomic.AddUint64(&b.corruptions, 1)
+		return entry{}, false
+	}
+	chunk := chunks[chunkIdx]
+	idx %= b.chunkSize
+	if idx+entryHeaderSize >= b.chunkSize {
+		// Corrupted data. Just skip it.
+		atomic.AddUint64(&b.corruptions, 1)
+		return entry{}, false
+	}
+	kvLenBuf := chunk[idx : idx+entryHeaderSize]
+	keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
+	valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
+	idx += entryHeaderSize
+	if idx+keyLen+valLen >= b.chunkSize {
+		// Corrupted data. Just skip it.
+		atomic.AddUint64(&b.corruptions, 1)
+		return entry{}, false
+	}
+	return entry{
+		key:      chunk[idx : idx+keyLen],
+		value:    chunk[idx+keyLen : idx+keyLen+valLen],
+		flags:    kvLenBuf[4],
+		expireAt: binary.BigEndian.Uint64(kvLenBuf[5:13]),
+		version:  binary.BigEndian.Uint64(kvLenBuf[13:]),
+	}, true
+}
+
+// chunkAllocator раздает chunks одного размера из памяти, выделенной через mmap.
+//
+// Память выделяется пачками по chunksPerAlloc chunks. Пачка, все chunks
+// которой вернулись через Put, отдается ОС в Trim.
+type chunkAllocator struct {
+	chunkSize      uint64
+	chunksPerAlloc uint64
+
+	mu   sync.Mutex
+	free [][]byte
+
+	// batches сопоставляет адрес chunk с пачкой, из которой он выделен.
+	batches map[uintptr]*chunkBatch
 
-func getChunk() []byte {
-	freeChunksLock.Lock()
-	if len(freeChunks) == 0 {
+	mappedBytes uint64
+	inUseBytes  uint64
+}
+
+// chunkBatch — память одного вызова mmap.
+type chunkBatch struct {
+	data []byte
+
+	// free количество chunks пачки, которые лежат в chunkAllocator.free.
+	free uint64
+}
+
+func (a *chunkAllocator) Get() []byte {
+	a.mu.Lock()
+	if len(a.free) == 0 {
         // Выделяем внекучную память, чтобы GOGC не учитывал размер кэша.
         // Это должно уменьшить потерю свободной памяти.
-		data, err := unix.Mmap(-1, 0, chunkSize*chunksPerAlloc, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+		data, err := unix.Mmap(-1, 0, int(a.chunkSize*a.chunksPerAlloc), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
 		if err != nil {
-			panic(fmt.Errorf("cannot allocate %d bytes via mmap: %s", chunkSize*chunksPerAlloc, err))
+			panic(fmt.Errorf("cannot allocate %d bytes via mmap: %s", a.chunkSize*a.chunksPerAlloc, err))
+		}
+		if a.batches == nil {
+			a.batches = make(map[uintptr]*chunkBatch)
 		}
+		batch := &chunkBatch{data: data, free: a.chunksPerAlloc}
+		a.mappedBytes += uint64(len(data))
 		for len(data) > 0 {
-			p := (*[chunkSize]byte)(unsafe.Pointer(&data[0]))
-			freeChunks = append(freeChunks, p)
-			data = data[chunkSize:]
+			chunk := data[:a.chunkSize:a.chunkSize]
+			a.free = append(a.free, chunk)
+			a.batches[chunkAddr(chunk)] = batch
+			data = data[a.chunkSize:]
 		}
 	}
-	n := len(freeChunks) - 1
-	p := freeChunks[n]
-	freeChunks[n] = nil
-	freeChunks = freeChunks[:n]
-	freeChunksLock.Unlock()
-	return p[:]
+	n := len(a.free) - 1
+	p := a.free[n]
+	a.free[n] = nil
+	a.free = a.free[:n]
+	a.batches[chunkAddr(p)].free--
+	a.inUseBytes += a.chunkSize
+	a.mu.Unlock()
+	return p
 }
 
-func putChunk(chunk []byte) {
+func (a *chunkAllocator) Put(chunk []byte) {
 	if chunk == nil {
 		return
 	}
-	chunk = chunk[:chunkSize]
-	p := (*[chunkSize]byte)(unsafe.Pointer(&chunk[0]))
+	chunk = chunk[:a.chunkSize]
+
+	a.mu.Lock()
+	a.free = append(a.free, chunk)
+	a.batches[chunkAddr(chunk)].free++
+	a.inUseBytes -= a.chunkSize
+	a.mu.Unlock()
+}
+
+// Trim возвращает ОС пачки, все chunks которых свободны.
+func (a *chunkAllocator) Trim() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	free := a.free[:0]
+	for _, chunk := range a.free {
+		if a.batches[chunkAddr(chunk)].free < a.chunksPerAlloc {
+			free = append(free, chunk)
+		}
+	}
+	for i := len(free); i < len(a.free); i++ {
+		a.free[i] = nil
+	}
+	a.free = free
+
+	var firstErr error
+	unmapped := make(map[*chunkBatch]struct{})
+	for addr, batch := range a.batches {
+		if batch.free < a.chunksPerAlloc {
+			continue
+		}
+		delete(a.batches, addr)
+		if _, ok := unmapped[batch]; ok {
+			continue
+		}
+		unmapped[batch] = struct{}{}
+		err := unix.Munmap(batch.data); if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot release %d bytes via munmap: %s", len(batch.data), err)
+		}
+		a.mappedBytes -= uint64(len(batch.data))
+	}
+	return firstErr
+}
+
+func (a *chunkAllocator) UpdateStats(s *Stats) {
+	a.mu.Lock()
+	s.MappedBytes += a.mappedBytes
+	s.InUseBytes += a.inUseBytes
+	a.mu.Unlock()
+}
 
-	freeChunksLock.Lock()
-	freeChunks = append(freeChunks, p)
-	freeChunksLock.Unlock()
-}
\ No newline at end of file
+func chunkAddr(chunk []byte) uintptr {
+	return uintptr(unsafe.Pointer(unsafe.SliceData(chunk)))
+}
@@ -0,0 +1,447 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t testing.TB, opts Options) *Cache {
+	t.Helper()
+	c, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("NewWithOptions: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close: %s", err)
+		}
+	})
+	return c
+}
+
+// testValue детерминированно строит значение для ключа k, начинающееся с "k:",
+// чтобы по значению можно было проверить, что оно принадлежит именно этому ключу.
+func testValue(k []byte, n int) []byte {
+	v := make([]byte, 0, n+len(k)+1)
+	v = append(v, k...)
+	v = append(v, ':')
+	for len(v) < cap(v) {
+		v = append(v, byte(len(v)*31))
+	}
+	return v
+}
+
+func TestSetGet(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 32 * 1024 * 1024})
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := testValue(k, i%500)
+		if err := c.Set(k, v); err != nil {
+			t.Fatalf("Set(%q): %s", k, err)
+		}
+		got, ok := c.HasGet(nil, k)
+		if !ok || !bytes.Equal(got, v) {
+			t.Fatalf("HasGet(%q) = %q, %v; want %q", k, got, ok, v)
+		}
+	}
+
+	// Пустое значение отличается от отсутствующего.
+	if err := c.Set([]byte("empty"), nil); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if got, ok := c.HasGet(nil, []byte("empty")); !ok || len(got) != 0 {
+		t.Fatalf("HasGet(empty) = %q, %v; want empty, true", got, ok)
+	}
+	if _, ok := c.HasGet(nil, []byte("missing")); ok {
+		t.Fatalf("HasGet(missing) found")
+	}
+
+	// Get добавляет значение к dst.
+	got := c.Get([]byte("prefix "), []byte("key 1"))
+	if want := append([]byte("prefix "), testValue([]byte("key 1"), 1)...); !bytes.Equal(got, want) {
+		t.Fatalf("Get with dst = %q; want %q", got, want)
+	}
+
+	if !c.Del([]byte("key 1")) {
+		t.Fatalf("Del(key 1) = false")
+	}
+	if c.Has([]byte("key 1")) || c.Del([]byte("key 1")) {
+		t.Fatalf("key 1 still in cache after Del")
+	}
+}
+
+// TestModelWraparound сверяет кеш с map при многократном обходе кольцевых буферов:
+// найденное значение всегда последнее записанное для ключа, удаленные ключи не находятся,
+// а только что записанный ключ всегда находится.
+func TestModelWraparound(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 64 * 1024, BucketsCount: 4, ChunkSize: 4096})
+	model := make(map[string][]byte)
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200000; i++ {
+		k := []byte(fmt.Sprintf("k%d", rnd.Intn(2000)))
+		switch op := rnd.Intn(10); {
+		case op < 6:
+			v := testValue(k, rnd.Intn(300))
+			if err := c.Set(k, v); err != nil {
+				t.Fatalf("Set: %s", err)
+			}
+			model[string(k)] = v
+			if got, ok := c.HasGet(nil, k); !ok || !bytes.Equal(got, v) {
+				t.Fatalf("step %d: fresh key %q not found", i, k)
+			}
+		case op < 7:
+			c.Del(k)
+			delete(model, string(k))
+		default:
+			got, ok := c.HasGet(nil, k)
+			want, inModel := model[string(k)]
+			if ok && (!inModel || !bytes.Equal(got, want)) {
+				t.Fatalf("step %d: HasGet(%q) = %q; model has %q, %v", i, k, got, want, inModel)
+			}
+		}
+	}
+
+	var s DetailedStats
+	c.UpdateDetailedStats(&s, 0)
+	var wraps uint64
+	for _, b := range s.Buckets {
+		wraps += b.GenWraps
+	}
+	if wraps < 100 {
+		t.Fatalf("only %d wraps; test does not exercise wraparound", wraps)
+	}
+	if s.Сorruptions != 0 {
+		t.Fatalf("%d corruptions", s.Сorruptions)
+	}
+	if s.EntriesCount > uint64(len(model)) {
+		t.Fatalf("EntriesCount %d > %d live keys", s.EntriesCount, len(model))
+	}
+}
+
+// TestGenOverflow проверяет переход поколения через maxGen:
+// поколение 0 пропускается, а записи прошлого поколения остаются видны.
+func TestGenOverflow(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 4 * 4096, BucketsCount: 1, ChunkSize: 4096})
+	b := &c.buckets[0]
+	b.mu.Lock()
+	b.gen = maxGen - 1
+	b.mu.Unlock()
+
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprint(i))
+		v := testValue(k, 1000)
+		if err := c.Set(k, v); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+		if got := c.Get(nil, k); !bytes.Equal(got, v) {
+			t.Fatalf("key %d not found right after Set", i)
+		}
+		// Предыдущие ключи либо вытеснены, либо целы, в том числе сразу после перехода.
+		for j := 0; j < i; j++ {
+			pk := []byte(fmt.Sprint(j))
+			if got, ok := c.HasGet(nil, pk); ok && !bytes.Equal(got, testValue(pk, 1000)) {
+				t.Fatalf("key %d returned foreign value after setting %d", j, i)
+			}
+		}
+		if i > 0 && !c.Has([]byte(fmt.Sprint(i-1))) {
+			t.Fatalf("key %d evicted by the next Set", i-1)
+		}
+	}
+
+	b.mu.RLock()
+	gen := b.gen & maxGen
+	b.mu.RUnlock()
+	if gen == 0 || gen >= maxGen-1 {
+		t.Fatalf("gen %d did not wrap past maxGen", gen)
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.Сorruptions != 0 {
+		t.Fatalf("%d corruptions", s.Сorruptions)
+	}
+}
+
+func TestBigValues(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 64 * 1024 * 1024})
+	sizes := []int{64*1024 - 100, 64 * 1024, 64*1024 + 1, 200 * 1024, 1024 * 1024}
+	for _, n := range sizes {
+		k := []byte(fmt.Sprintf("big %d", n))
+		v := testValue(k, n)
+		if err := c.Set(k, v); err != nil {
+			t.Fatalf("Set(%d bytes): %s", n, err)
+		}
+		if got := c.Get(nil, k); !bytes.Equal(got, v) {
+			t.Fatalf("Get(%d bytes) returned %d bytes", n, len(got))
+		}
+		if !c.Has(k) {
+			t.Fatalf("Has(%d bytes) = false", n)
+		}
+	}
+
+	// Части большого значения не видны как самостоятельные записи.
+	n := 0
+	c.Visit(func(k, v []byte) bool {
+		n++
+		if !bytes.HasPrefix(k, []byte("big ")) || !bytes.HasPrefix(v, k) {
+			t.Fatalf("Visit returned %q", k)
+		}
+		return true
+	})
+	if n != len(sizes) {
+		t.Fatalf("Visit visited %d entries; want %d", n, len(sizes))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	opts := Options{MaxBytes: 32 * 1024 * 1024, Compression: CompressionS2}
+	c := newTestCache(t, opts)
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprint(i))
+		if err := c.Set(k, testValue(k, i)); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+	path := t.TempDir() + "/cache.snapshot"
+	if err := c.SaveToFile(path); err != nil {
+		t.Fatalf("SaveToFile: %s", err)
+	}
+
+	loaded, err := LoadFromFileWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("LoadFromFile: %s", err)
+	}
+	defer loaded.Close()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprint(i))
+		if got := loaded.Get(nil, k); !bytes.Equal(got, testValue(k, i)) {
+			t.Fatalf("key %d lost after load", i)
+		}
+	}
+
+	if _, err := LoadFromFileWithOptions(path, Options{MaxBytes: opts.MaxBytes, BucketsCount: 16}); err == nil {
+		t.Fatalf("LoadFromFile with other geometry succeeded")
+	}
+}
+
+// TestSnapshotCorruptedHeader проверяет, что размеры из заголовка bucket
+// проверяются до выделения памяти под них.
+func TestSnapshotCorruptedHeader(t *testing.T) {
+	opts := Options{MaxBytes: 32 * 1024 * 1024}
+	c := newTestCache(t, opts)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprint(i))
+		if err := c.Set(k, testValue(k, i)); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+	path := t.TempDir() + "/cache.snapshot"
+	if err := c.SaveToFile(path); err != nil {
+		t.Fatalf("SaveToFile: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+
+	// Заголовок первого bucket идет за заголовком файла: idx, gen, chunksLen, mLen.
+	const chunksLenOff, mLenOff = 48, 56
+	chunksLen := binary.LittleEndian.Uint64(data[chunksLenOff:])
+	maxEntries := chunksLen * c.chunkSize / entryHeaderSize
+	tests := []struct {
+		name      string
+		chunksLen uint64
+		mLen      uint64
+	}{
+		{name: "huge chunks", chunksLen: 1 << 40, mLen: 1},
+		{name: "max bucket size", chunksLen: maxBucketSize / c.chunkSize, mLen: maxBucketSize / entryHeaderSize},
+		{name: "more chunks than configured", chunksLen: chunksLen + 1, mLen: 1},
+		{name: "huge entries", chunksLen: chunksLen, mLen: 1 << 40},
+		{name: "entries past end of file", chunksLen: chunksLen, mLen: maxEntries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupted := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint64(corrupted[chunksLenOff:], tt.chunksLen)
+			binary.LittleEndian.PutUint64(corrupted[mLenOff:], tt.mLen)
+			path := t.TempDir() + "/cache.snapshot"
+			if err := os.WriteFile(path, corrupted, 0o644); err != nil {
+				t.Fatalf("WriteFile: %s", err)
+			}
+			loaded, err := LoadFromFileWithOptions(path, opts)
+			if err == nil {
+				loaded.Close()
+			}
+			if !errors.Is(err, ErrSnapshotCorrupted) {
+				t.Fatalf("LoadFromFile: %v; want ErrSnapshotCorrupted", err)
+			}
+		})
+	}
+}
+
+// TestVisitStats проверяет, что обход кеша не меняет его статистику,
+// в том числе для сжатых и больших значений.
+func TestVisitStats(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 32 * 1024 * 1024, Compression: CompressionS2, PromoteOnHit: true})
+	keys := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		n := i * 10
+		if i%10 == 0 {
+			n = 100 * 1024
+		}
+		if err := c.Set(k, testValue(k, n)); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+		keys[string(k)] = true
+	}
+	var before Stats
+	c.UpdateStats(&before)
+
+	n := 0
+	c.Visit(func(k, v []byte) bool {
+		if !keys[string(k)] || !isTestValue(k, v) {
+			t.Fatalf("Visit returned %q", k)
+		}
+		n++
+		return true
+	})
+	if n != len(keys) {
+		t.Fatalf("Visit visited %d entries; want %d", n, len(keys))
+	}
+	n = 0
+	c.VisitKeys(func(k []byte) bool {
+		if !keys[string(k)] {
+			t.Fatalf("VisitKeys returned %q", k)
+		}
+		n++
+		return true
+	})
+	if n != len(keys) {
+		t.Fatalf("VisitKeys visited %d keys; want %d", n, len(keys))
+	}
+
+	var after Stats
+	c.UpdateStats(&after)
+	if after.GetCalls != before.GetCalls || after.Misses != before.Misses || after.Promotions != before.Promotions {
+		t.Fatalf("stats changed by Visit: %+v -> %+v", before, after)
+	}
+}
+
+// TestGetOrLoadPanic проверяет, что паника loader не выглядит успехом
+// для вызовов, ждущих ту же загрузку.
+func TestGetOrLoadPanic(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 32 * 1024 * 1024})
+	k := []byte("key")
+	release := make(chan struct{})
+	loader := func(k []byte) ([]byte, time.Duration, error) {
+		<-release
+		panic("loader failed")
+	}
+
+	leaderDone := make(chan any)
+	go func() {
+		defer func() { leaderDone <- recover() }()
+		c.GetOrLoad(nil, k, loader)
+	}()
+	for atomic.LoadUint64(&c.loads.loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiterDone := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(nil, k, loader)
+		waiterDone <- err
+	}()
+	for atomic.LoadUint64(&c.loads.shared) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if p := <-leaderDone; p == nil {
+		t.Fatalf("leader did not panic")
+	}
+	if err := <-waiterDone; !errors.Is(err, ErrLoaderPanic) {
+		t.Fatalf("waiter got %v; want ErrLoaderPanic", err)
+	}
+	if c.Has(k) {
+		t.Fatalf("value cached after loader panic")
+	}
+}
+
+// TestNamespaceBytes проверяет, что квоты пространств имен вырезаются
+// из MaxBytes, а не добавляются к нему.
+func TestNamespaceBytes(t *testing.T) {
+	const maxBytes = 32 * 1024 * 1024
+	c := newTestCache(t, Options{MaxBytes: maxBytes, NamespaceBytes: 2 * 1024 * 1024})
+	var namespaces []*Namespace
+	for _, name := range []string{"a", "b"} {
+		ns, err := c.Namespace(name, 1024*1024)
+		if err != nil {
+			t.Fatalf("Namespace(%s): %s", name, err)
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	chunks := func(c *Cache) uint64 {
+		var n uint64
+		for i := range c.buckets {
+			n += c.buckets[i].chunksCount()
+		}
+		return n
+	}
+	total := chunks(c)
+	for _, ns := range namespaces {
+		total += chunks(ns.Cache)
+	}
+	if total*c.chunkSize != maxBytes {
+		t.Fatalf("cache with namespaces takes %d bytes; want %d", total*c.chunkSize, maxBytes)
+	}
+}
+
+// TestSetIfNewerAdmission проверяет, что допуск по частоте отклоняет
+// новые ключи SetIfNewer, но не новые версии закешированных.
+func TestSetIfNewerAdmission(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 1024 * 1024, BucketsCount: 1, ChunkSize: 4096, AdmitMinFrequency: 100})
+	b := &c.buckets[0]
+	fill := func(done func() bool) {
+		for i := 0; !done(); i++ {
+			k := []byte(fmt.Sprintf("fill %d %d", b.gen, i))
+			if err := c.Set(k, testValue(k, 100)); err != nil {
+				t.Fatalf("Set: %s", err)
+			}
+		}
+	}
+	// Ключ пишется в последний chunk, чтобы пережить переполнение bucket.
+	fill(func() bool { return b.idx >= uint64(len(b.chunks)-1)*b.chunkSize })
+	cached := []byte("cached")
+	if ok, err := c.SetIfNewer(cached, []byte("v1"), 1); !ok || err != nil {
+		t.Fatalf("SetIfNewer before bucket is full: %v, %v", ok, err)
+	}
+	fill(func() bool { return b.gen > 1 })
+
+	if ok, err := c.SetIfNewer([]byte("new"), []byte("v1"), 1); ok || err != nil {
+		t.Fatalf("SetIfNewer of rare new key: %v, %v", ok, err)
+	}
+	if c.Has([]byte("new")) {
+		t.Fatalf("rare new key admitted")
+	}
+	if ok, err := c.SetIfNewer(cached, []byte("v2"), 2); !ok || err != nil {
+		t.Fatalf("SetIfNewer of cached key: %v, %v", ok, err)
+	}
+	if v, version, _ := c.GetWithVersion(nil, cached); string(v) != "v2" || version != 2 {
+		t.Fatalf("cached key: %q version %d; want v2 version 2", v, version)
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	if s.AdmissionRejects != 1 {
+		t.Fatalf("AdmissionRejects = %d; want 1", s.AdmissionRejects)
+	}
+}
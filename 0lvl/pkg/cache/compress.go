@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression — кодек, которым сжимаются значения перед записью в chunks.
+type Compression uint8
+
+const (
+	// CompressionNone — значения хранятся как есть.
+	CompressionNone Compression = iota
+
+	// CompressionS2 — быстрый кодек, совместимый по духу со snappy.
+	CompressionS2
+
+	// CompressionZstd — сжимает сильнее S2, но медленнее.
+	CompressionZstd
+)
+
+// minCompressLen значения короче не сжимаются: выигрыш меньше накладных расходов.
+const minCompressLen = 64
+
+// ParseCompression возвращает кодек по названию: "none", "s2" или "zstd".
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "s2":
+		return CompressionS2, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown cache compression %q", name)
+}
+
+// compressFlags флаги записи для каждого кодека.
+var compressFlags = [...]byte{
+	CompressionNone: 0,
+	CompressionS2:   flagS2,
+	CompressionZstd: flagZstd,
+}
+
+// compressStats считает, сколько байт сэкономило сжатие.
+type compressStats struct {
+	rawBytes        uint64
+	compressedBytes uint64
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd создает общие для всех кешей кодировщик и декодировщик zstd.
+// Их EncodeAll/DecodeAll безопасны для конкурентного вызова.
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest)); if err != nil {
+			panic(fmt.Errorf("cannot create zstd encoder: %s", err))
+		}
+		zstdDecoder, err = zstd.NewReader(nil); if err != nil {
+			panic(fmt.Errorf("cannot create zstd decoder: %s", err))
+		}
+	})
+}
+
+// compress сжимает v кодеком кеша. Если сжатие выключено или не дало выигрыша,
+// возвращает v и нулевые флаги.
+func (c *Cache) compress(v []byte) ([]byte, byte) {
+	codec := c.opts.Compression
+	if codec == CompressionNone || len(v) < minCompressLen {
+		return v, 0
+	}
+	var cv []byte
+	switch codec {
+	case CompressionS2:
+		cv = s2.Encode(nil, v)
+	case CompressionZstd:
+		initZstd()
+		cv = zstdEncoder.EncodeAll(v, nil)
+	}
+	if len(cv) >= len(v) {
+		return v, 0
+	}
+	atomic.AddUint64(&c.compressStats.rawBytes, uint64(len(v)))
+	atomic.AddUint64(&c.compressStats.compressedBytes, uint64(len(cv)))
+	return cv, compressFlags[codec]
+}
+
+// decompress распаковывает значение dst[dstLen:], сжатое с флагами flags,
+// и возвращает dst с распакованным значением на его месте.
+//
+// Декодер выбирается по флагам записи, а не по Options.Compression,
+// поэтому кеш читает значения из снапшота с другим кодеком.
+func (c *Cache) decompress(dst []byte, dstLen int, flags byte) ([]byte, bool) {
+	var v []byte
+	var err error
+	switch {
+	case flags&flagS2 != 0:
+		v, err = s2.Decode(nil, dst[dstLen:])
+	case flags&flagZstd != 0:
+		initZstd()
+		v, err = zstdDecoder.DecodeAll(dst[dstLen:], nil)
+	default:
+		return dst, true
+	}
+	if err != nil {
+		return dst[:dstLen], false
+	}
+	return append(dst[:dstLen], v...), true
+}
@@ -0,0 +1,535 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// diskFlushInterval как часто накопленные записи дописываются в файлы второго уровня.
+const diskFlushInterval = 100 * time.Millisecond
+
+// diskMaxPending сколько байт вытесненных записей может ждать записи на диск.
+// Сверх этого записи отбрасываются, а не тормозят Set.
+const diskMaxPending = 8 * 1024 * 1024
+
+// diskIndexRecordSize размер записи индекса: хеш ключа (8 байт),
+// смещение в файле данных (8 байт) и длина записи (4 байта, 0 — удаление ключа).
+const diskIndexRecordSize = 20
+
+// diskIndexHeaderSize размер заголовка файла индекса: магия и номер сегмента.
+const diskIndexHeaderSize = 16
+
+var diskIndexMagic = [8]byte{'0', 'l', 'v', 'l', 'd', 'i', 's', 'k'}
+
+// diskLoc — место записи в сегменте.
+type diskLoc struct {
+	seg  uint8
+	size uint32
+	off  uint64
+}
+
+// diskRef — место записи, прочитанной Get, вместе с номером сегмента,
+// чтобы отличить ее от записи, попавшей на то же место после ротации.
+type diskRef struct {
+	loc diskLoc
+	seq uint64
+}
+
+// diskRecord — живая запись вытесняемого chunk, см. bucket.spillLocked.
+type diskRecord struct {
+	h    uint64
+	data []byte
+}
+
+// diskSegment — пара файлов второго уровня: данные и индекс к ним.
+// Оба файла только дописываются до ротации.
+type diskSegment struct {
+	data  *os.File
+	index *os.File
+
+	// seq растет с каждой ротацией: при открытии сегмент с меньшим seq старше.
+	// 0 — сегмент пуст.
+	seq uint64
+
+	// size и indexSize сколько байт уже записано в файлы.
+	size      uint64
+	indexSize uint64
+
+	// flushing пишется в файлы без блокировки, pending копит новые записи.
+	// Смещения записей в них продолжают файл данных.
+	flushing      []byte
+	flushingIndex []byte
+	pending       []byte
+	pendingIndex  []byte
+}
+
+// diskTier — второй уровень кеша на диске.
+//
+// Живые записи вытесняемых из памяти chunks дописываются в активный сегмент,
+// а индекс хеш ключа -> место записи хранится в памяти и дописывается в файл индекса,
+// чтобы пережить перезапуск. Когда активный сегмент дорастает до половины
+// емкости, запись переключается на второй сегмент, а его старое содержимое
+// отбрасывается целиком.
+//
+// Ключ лежит не более чем в одном уровне: запись ключа в память
+// и Del удаляют его с диска, см. Forget.
+type diskTier struct {
+	// flushMu упорядочивает запись в файлы, ротацию, Reset и Close.
+	// Порядок блокировок: flushMu, затем mu; bucket.mu, затем mu.
+	flushMu sync.Mutex
+
+	mu          sync.RWMutex
+	segs        [2]diskSegment
+	active      int
+	segMaxBytes uint64
+	index       map[uint64]diskLoc
+	closed      bool
+
+	stop chan struct{}
+	done chan struct{}
+
+	hits    uint64
+	spills  uint64
+	dropped uint64
+	errors  uint64
+}
+
+// openDiskTier открывает второй уровень в каталоге dir емкостью maxBytes,
+// поднимая индекс записей, сохраненных прошлым процессом.
+func openDiskTier(dir string, maxBytes uint64) (*diskTier, error) {
+	err := os.MkdirAll(dir, 0o755); if err != nil {
+		return nil, err
+	}
+	d := &diskTier{
+		segMaxBytes: maxBytes / 2,
+		index:       make(map[uint64]diskLoc),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for i := range d.segs {
+		s := &d.segs[i]
+		s.data, err = os.OpenFile(filepath.Join(dir, fmt.Sprintf("segment-%d.data", i)), os.O_RDWR|os.O_CREATE, 0o644); if err != nil {
+			d.closeFiles()
+			return nil, err
+		}
+		s.index, err = os.OpenFile(filepath.Join(dir, fmt.Sprintf("segment-%d.index", i)), os.O_RDWR|os.O_CREATE, 0o644); if err != nil {
+			d.closeFiles()
+			return nil, err
+		}
+	}
+
+	// Старший сегмент применяется первым, чтобы записи младшего его перекрыли.
+	older, newer := 0, 1
+	indexes := [2][]byte{}
+	for i := range d.segs {
+		indexes[i], err = d.segs[i].open(); if err != nil {
+			d.closeFiles()
+			return nil, err
+		}
+	}
+	if d.segs[0].seq > d.segs[1].seq {
+		older, newer = 1, 0
+	}
+	d.load(older, indexes[older])
+	d.load(newer, indexes[newer])
+	d.active = newer
+	if d.segs[newer].seq == 0 {
+		err = d.segs[newer].truncate(d.segs[older].seq + 1); if err != nil {
+			d.closeFiles()
+			return nil, err
+		}
+	}
+
+	go d.run()
+	return d, nil
+}
+
+// open читает индекс сегмента и возвращает его записи без заголовка.
+// Сегмент с испорченным заголовком считается пустым.
+func (s *diskSegment) open() ([]byte, error) {
+	st, err := s.data.Stat(); if err != nil {
+		return nil, err
+	}
+	index, err := io.ReadAll(io.NewSectionReader(s.index, 0, 1<<62)); if err != nil {
+		return nil, err
+	}
+	if len(index) < diskIndexHeaderSize || !bytes.Equal(index[:8], diskIndexMagic[:]) {
+		return nil, s.truncate(0)
+	}
+	s.seq = binary.LittleEndian.Uint64(index[8:16])
+	s.size = uint64(st.Size())
+	index = index[diskIndexHeaderSize:]
+	// Недописанная последняя запись индекса отбрасывается.
+	index = index[:len(index)-len(index)%diskIndexRecordSize]
+	s.indexSize = uint64(diskIndexHeaderSize + len(index))
+	return index, nil
+}
+
+// load применяет записи индекса сегмента seg.
+func (d *diskTier) load(seg int, index []byte) {
+	s := &d.segs[seg]
+	for ; len(index) > 0; index = index[diskIndexRecordSize:] {
+		h := binary.LittleEndian.Uint64(index[0:8])
+		off := binary.LittleEndian.Uint64(index[8:16])
+		size := binary.LittleEndian.Uint32(index[16:20])
+		if size == 0 {
+			delete(d.index, h)
+			continue
+		}
+		// Данные могли не успеть записаться до падения процесса.
+		if off+uint64(size) > s.size {
+			continue
+		}
+		d.index[h] = diskLoc{seg: uint8(seg), size: size, off: off}
+	}
+}
+
+// truncate очищает сегмент и помечает его номером seq.
+func (s *diskSegment) truncate(seq uint64) error {
+	s.seq = seq
+	s.size = 0
+	s.indexSize = 0
+	s.flushing, s.flushingIndex = nil, nil
+	s.pending, s.pendingIndex = nil, nil
+	err := s.data.Truncate(0); if err != nil {
+		return err
+	}
+	err = s.index.Truncate(0); if err != nil {
+		return err
+	}
+	if seq == 0 {
+		return nil
+	}
+	var header [diskIndexHeaderSize]byte
+	copy(header[:8], diskIndexMagic[:])
+	binary.LittleEndian.PutUint64(header[8:], seq)
+	_, err = s.index.WriteAt(header[:], 0); if err != nil {
+		return err
+	}
+	s.indexSize = diskIndexHeaderSize
+	return nil
+}
+
+func appendDiskIndexRecord(dst []byte, h, off uint64, size uint32) []byte {
+	var rec [diskIndexRecordSize]byte
+	binary.LittleEndian.PutUint64(rec[0:8], h)
+	binary.LittleEndian.PutUint64(rec[8:16], off)
+	binary.LittleEndian.PutUint32(rec[16:20], size)
+	return append(dst, rec[:]...)
+}
+
+// Spill дописывает записи recs в активный сегмент.
+// Вызывается под блокировкой bucket, поэтому на диск записи попадут позже, в flush.
+func (d *diskTier) Spill(recs []diskRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	s := &d.segs[d.active]
+	for i, r := range recs {
+		if len(s.pending)+len(r.data) > diskMaxPending {
+			atomic.AddUint64(&d.dropped, uint64(len(recs)-i))
+			return
+		}
+		off := s.size + uint64(len(s.flushing)) + uint64(len(s.pending))
+		s.pending = append(s.pending, r.data...)
+		s.pendingIndex = appendDiskIndexRecord(s.pendingIndex, r.h, off, uint32(len(r.data)))
+		d.index[r.h] = diskLoc{seg: uint8(d.active), size: uint32(len(r.data)), off: off}
+	}
+	atomic.AddUint64(&d.spills, uint64(len(recs)))
+}
+
+// Forget удаляет с диска запись с хешем ключа h.
+// Возвращает true, если такая запись была.
+func (d *diskTier) Forget(h uint64) bool {
+	d.mu.RLock()
+	_, ok := d.index[h]
+	d.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok = d.index[h]
+	if !ok || d.closed {
+		return false
+	}
+	delete(d.index, h)
+	s := &d.segs[d.active]
+	s.pendingIndex = appendDiskIndexRecord(s.pendingIndex, h, 0, 0)
+	return true
+}
+
+// Get добавляет в dst значение ключа k с хешем h и возвращает запись с его метаданными
+// и ее место, см. Holds. Значение записи ссылается на dst.
+func (d *diskTier) Get(dst, k []byte, h uint64) ([]byte, entry, diskRef, bool) {
+	dstLen := len(dst)
+	d.mu.RLock()
+	loc, ok := d.index[h]
+	if !ok || d.closed {
+		d.mu.RUnlock()
+		return dst, entry{}, diskRef{}, false
+	}
+	s := &d.segs[loc.seg]
+	ref := diskRef{loc: loc, seq: s.seq}
+	if loc.off >= s.size {
+		off := loc.off - s.size
+		if off < uint64(len(s.flushing)) {
+			dst = append(dst, s.flushing[off:off+uint64(loc.size)]...)
+		} else {
+			off -= uint64(len(s.flushing))
+			dst = append(dst, s.pending[off:off+uint64(loc.size)]...)
+		}
+	} else {
+		dst = append(dst, make([]byte, loc.size)...)
+		_, err := s.data.ReadAt(dst[dstLen:], int64(loc.off)); if err != nil {
+			d.mu.RUnlock()
+			atomic.AddUint64(&d.errors, 1)
+			return dst[:dstLen], entry{}, diskRef{}, false
+		}
+	}
+	d.mu.RUnlock()
+
+	e, ok := decodeDiskRecord(dst[dstLen:])
+	if !ok {
+		atomic.AddUint64(&d.errors, 1)
+		return dst[:dstLen], entry{}, diskRef{}, false
+	}
+	if string(e.key) != string(k) || e.expired(uint64(time.Now().UnixNano())) {
+		return dst[:dstLen], entry{}, diskRef{}, false
+	}
+	// Значение сдвигается на место записи в dst.
+	n := copy(dst[dstLen:], e.value)
+	dst = dst[:dstLen+n]
+	e.key = nil
+	e.value = dst[dstLen:]
+	atomic.AddUint64(&d.hits, 1)
+	return dst, e, ref, true
+}
+
+// Holds сообщает, что запись с хешем ключа h все еще лежит там, откуда ее прочитал Get:
+// с тех пор ключ не удаляли, не записывали в память и не вытесняли заново.
+func (d *diskTier) Holds(h uint64, ref diskRef) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	loc, ok := d.index[h]
+	return ok && !d.closed && loc == ref.loc && d.segs[loc.seg].seq == ref.seq
+}
+
+// decodeDiskRecord раскодирует запись в формате chunk, см. bucket.setLocked.
+func decodeDiskRecord(rec []byte) (entry, bool) {
+	if len(rec) < entryHeaderSize {
+		return entry{}, false
+	}
+	keyLen := (uint64(rec[0]) << 8) | uint64(rec[1])
+	valLen := (uint64(rec[2]) << 8) | uint64(rec[3])
+	if uint64(len(rec)) != entryHeaderSize+keyLen+valLen {
+		return entry{}, false
+	}
+	body := rec[entryHeaderSize:]
+	return entry{
+		key:      body[:keyLen],
+		value:    body[keyLen:],
+		flags:    rec[4],
+		expireAt: binary.BigEndian.Uint64(rec[5:13]),
+		version:  binary.BigEndian.Uint64(rec[13:21]),
+	}, true
+}
+
+func (d *diskTier) run() {
+	defer close(d.done)
+	t := time.NewTicker(diskFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-t.C:
+			d.flush()
+		}
+	}
+}
+
+// flush дописывает накопленные записи активного сегмента в файлы
+// и переключает сегменты, если активный заполнен.
+func (d *diskTier) flush() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	seg := d.active
+	s := &d.segs[seg]
+	s.flushing, s.pending = s.pending, nil
+	s.flushingIndex, s.pendingIndex = s.pendingIndex, nil
+	if s.size+uint64(len(s.flushing)) >= d.segMaxBytes {
+		d.rotateLocked()
+	}
+	d.mu.Unlock()
+
+	if len(s.flushing) == 0 && len(s.flushingIndex) == 0 {
+		return
+	}
+	// Данные пишутся раньше индекса: запись индекса без данных отбросит load.
+	_, err := s.data.WriteAt(s.flushing, int64(s.size))
+	if err == nil {
+		_, err = s.index.WriteAt(s.flushingIndex, int64(s.indexSize))
+	}
+
+	d.mu.Lock()
+	if err != nil {
+		atomic.AddUint64(&d.errors, 1)
+		// Незаписанные записи больше не прочитать.
+		for h, loc := range d.index {
+			if int(loc.seg) == seg && loc.off >= s.size {
+				delete(d.index, h)
+			}
+		}
+	} else {
+		s.size += uint64(len(s.flushing))
+		s.indexSize += uint64(len(s.flushingIndex))
+	}
+	s.flushing, s.flushingIndex = nil, nil
+	d.mu.Unlock()
+}
+
+// rotateLocked делает активным второй сегмент, отбрасывая его записи.
+// Вызывающий держит flushMu и mu.
+func (d *diskTier) rotateLocked() {
+	next := 1 - d.active
+	for h, loc := range d.index {
+		if int(loc.seg) == next {
+			delete(d.index, h)
+		}
+	}
+	err := d.segs[next].truncate(d.segs[d.active].seq + 1); if err != nil {
+		atomic.AddUint64(&d.errors, 1)
+		return
+	}
+	d.active = next
+}
+
+// Reset удаляет все записи второго уровня.
+func (d *diskTier) Reset() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.index = make(map[uint64]diskLoc)
+	seq := d.segs[d.active].seq
+	err := d.segs[1-d.active].truncate(0); if err != nil {
+		atomic.AddUint64(&d.errors, 1)
+	}
+	err = d.segs[d.active].truncate(seq + 1); if err != nil {
+		atomic.AddUint64(&d.errors, 1)
+	}
+}
+
+// Close дописывает накопленные записи и закрывает файлы.
+// Записи остаются на диске для следующего openDiskTier.
+func (d *diskTier) Close() error {
+	d.flushMu.Lock()
+	closed := d.closed
+	d.flushMu.Unlock()
+	if closed {
+		return nil
+	}
+	close(d.stop)
+	<-d.done
+	d.flush()
+
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.index = nil
+	return d.closeFiles()
+}
+
+func (d *diskTier) closeFiles() error {
+	var errs []error
+	for i := range d.segs {
+		s := &d.segs[i]
+		if s.data != nil {
+			errs = append(errs, s.data.Close())
+		}
+		if s.index != nil {
+			errs = append(errs, s.index.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *diskTier) UpdateStats(s *Stats) {
+	s.DiskHits += atomic.LoadUint64(&d.hits)
+	s.DiskSpills += atomic.LoadUint64(&d.spills)
+	s.DiskDropped += atomic.LoadUint64(&d.dropped)
+	s.DiskErrors += atomic.LoadUint64(&d.errors)
+
+	d.mu.RLock()
+	s.DiskEntries += uint64(len(d.index))
+	for i := range d.segs {
+		seg := &d.segs[i]
+		s.DiskBytes += seg.size + uint64(len(seg.flushing)+len(seg.pending))
+	}
+	d.mu.RUnlock()
+}
+
+// spillLocked передает во второй уровень живые записи chunk chunkIdx,
+// который сейчас будет перезаписан. Вызывающий держит b.mu.
+//
+// Части больших значений и их мета-записи на диск не попадают.
+func (b *bucket) spillLocked(chunkIdx uint64) {
+	chunk := b.chunks[chunkIdx]
+	now := uint64(time.Now().UnixNano())
+	recs := b.spillBuf[:0]
+	for off := uint64(0); off+entryHeaderSize <= uint64(len(chunk)); {
+		keyLen := (uint64(chunk[off]) << 8) | uint64(chunk[off+1])
+		valLen := (uint64(chunk[off+2]) << 8) | uint64(chunk[off+3])
+		size := entryHeaderSize + keyLen + valLen
+		if off+size > uint64(len(chunk)) {
+			break
+		}
+		rec := chunk[off : off+size]
+		pos := chunkIdx*b.chunkSize + off
+		off += size
+
+		e, ok := decodeDiskRecord(rec)
+		if !ok || e.flags&(flagBigMeta|flagBigPart) != 0 || e.expired(now) {
+			continue
+		}
+		h := xxhash.Sum64(e.key)
+		// Запись жива, только если индекс указывает именно на нее.
+		v := b.m[h]
+		if v == 0 || v&((1<<bucketSizeBits)-1) != pos {
+			continue
+		}
+		recs = append(recs, diskRecord{h: h, data: rec})
+	}
+	if len(recs) > 0 {
+		b.disk.Spill(recs)
+	}
+	for i := range recs {
+		recs[i].data = nil
+	}
+	b.spillBuf = recs[:0]
+}
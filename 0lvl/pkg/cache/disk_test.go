@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// diskTestOptions — кеш из одного bucket на 8 chunks, который быстро вытесняет записи на диск.
+func diskTestOptions(dir string) Options {
+	return Options{MaxBytes: 8 * 4096, BucketsCount: 1, ChunkSize: 4096, DiskPath: dir, DiskMaxBytes: 1024 * 1024}
+}
+
+func diskTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key %d", i))
+}
+
+// setDiskTestKeys пишет n ключей и возвращает те, что вытеснены из памяти.
+func setDiskTestKeys(t *testing.T, c *Cache, n int) [][]byte {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		k := diskTestKey(i)
+		if err := c.Set(k, testValue(k, 100)); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+	var spilled [][]byte
+	for i := 0; i < n; i++ {
+		k := diskTestKey(i)
+		if _, ok := c.peek(nil, k); !ok {
+			spilled = append(spilled, k)
+		}
+	}
+	if len(spilled) == 0 {
+		t.Fatalf("no keys spilled to disk")
+	}
+	return spilled
+}
+
+// TestDiskSpill проверяет, что вытесненные из памяти записи находятся на диске,
+// а Has учитывает такое обращение как один Get.
+func TestDiskSpill(t *testing.T) {
+	c := newTestCache(t, diskTestOptions(t.TempDir()))
+	spilled := setDiskTestKeys(t, c, 500)
+
+	var before, after Stats
+	c.UpdateStats(&before)
+	if !c.Has(spilled[0]) {
+		t.Fatalf("Has(%q) = false for spilled key", spilled[0])
+	}
+	c.UpdateStats(&after)
+	if after.GetCalls-before.GetCalls != 1 || after.Misses-before.Misses != 1 || after.DiskHits-before.DiskHits != 1 {
+		t.Fatalf("Has of spilled key: GetCalls +%d, Misses +%d, DiskHits +%d; want +1 each",
+			after.GetCalls-before.GetCalls, after.Misses-before.Misses, after.DiskHits-before.DiskHits)
+	}
+
+	for _, k := range spilled[1:] {
+		v, ok := c.HasGet(nil, k)
+		if !ok || !isTestValue(k, v) {
+			t.Fatalf("HasGet(%q) = %q, %v", k, v, ok)
+		}
+	}
+}
+
+// TestDiskReopen проверяет, что записи на диске переживают Close,
+// а удаленные Del не возвращаются после открытия.
+func TestDiskReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewWithOptions(diskTestOptions(dir))
+	if err != nil {
+		t.Fatalf("NewWithOptions: %s", err)
+	}
+	spilled := setDiskTestKeys(t, c, 500)
+	deleted := spilled[len(spilled)-1]
+	spilled = spilled[:len(spilled)-1]
+	if !c.Del(deleted) {
+		t.Fatalf("Del(%q) = false for spilled key", deleted)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	c = newTestCache(t, diskTestOptions(dir))
+	if c.Has(deleted) {
+		t.Fatalf("deleted key %q found after reopen", deleted)
+	}
+	for _, k := range spilled {
+		v, ok := c.HasGet(nil, k)
+		if !ok || !isTestValue(k, v) {
+			t.Fatalf("HasGet(%q) after reopen = %q, %v", k, v, ok)
+		}
+	}
+}
+
+// TestDiskRotation проверяет, что при переключении сегментов отбрасываются
+// только самые старые записи, а диск не растет больше емкости.
+func TestDiskRotation(t *testing.T) {
+	dir := t.TempDir()
+	opts := diskTestOptions(dir)
+	opts.DiskMaxBytes = 64 * 1024
+	c := newTestCache(t, opts)
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		k := diskTestKey(i)
+		if err := c.Set(k, testValue(k, 100)); err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+		if i%100 == 99 {
+			c.disk.flush()
+		}
+	}
+	if c.disk.segs[c.disk.active].seq < 3 {
+		t.Fatalf("segments rotated %d times; want at least 2", c.disk.segs[c.disk.active].seq-1)
+	}
+	var s Stats
+	c.UpdateStats(&s)
+	// Активный сегмент может перерасти половину емкости на одну пачку flush.
+	if s.DiskBytes > opts.DiskMaxBytes+16*1024 {
+		t.Fatalf("DiskBytes = %d; want at most %d", s.DiskBytes, opts.DiskMaxBytes+16*1024)
+	}
+
+	// Читаем диск напрямую, чтобы чтение не возвращало записи в память.
+	diskGet := func(k []byte) ([]byte, bool) {
+		v, _, _, ok := c.disk.Get(nil, k, xxhash.Sum64(k))
+		return v, ok
+	}
+	if _, ok := diskGet(diskTestKey(0)); ok {
+		t.Fatalf("oldest key survived rotation")
+	}
+	found := 0
+	for i := 0; i < n; i++ {
+		k := diskTestKey(i)
+		v, ok := diskGet(k)
+		if !ok {
+			continue
+		}
+		if !isTestValue(k, v) {
+			t.Fatalf("disk value of %q = %q", k, v)
+		}
+		found++
+	}
+	// Предыдущий сегмент заполнен хотя бы на половину емкости.
+	k := diskTestKey(n - 1)
+	recSize := entryHeaderSize + len(k) + len(testValue(k, 100))
+	if found*recSize < int(opts.DiskMaxBytes/2) {
+		t.Fatalf("only %d keys left on disk after rotation", found)
+	}
+}
+
+// TestDiskSetFromDiskStale проверяет, что запись, прочитанная с диска до Del
+// или SetIfNewer того же ключа, не возвращается после них в память.
+// Повторяет по шагам чередование Get с ними, которое в гонке случается редко.
+func TestDiskSetFromDiskStale(t *testing.T) {
+	c := newTestCache(t, diskTestOptions(t.TempDir()))
+	spilled := setDiskTestKeys(t, c, 500)
+	read := func(k []byte) (*bucket, uint64, entry, diskRef) {
+		h := xxhash.Sum64(k)
+		_, e, ref, ok := c.disk.Get(nil, k, h)
+		if !ok {
+			t.Fatalf("key %q not on disk", k)
+		}
+		return c.bucket(h), h, e, ref
+	}
+
+	deleted := spilled[0]
+	b, h, e, ref := read(deleted)
+	if !c.Del(deleted) {
+		t.Fatalf("Del(%q) = false", deleted)
+	}
+	b.SetFromDisk(deleted, h, e, ref)
+	if c.Has(deleted) {
+		t.Fatalf("deleted key %q came back from disk", deleted)
+	}
+
+	updated := spilled[1]
+	b, h, e, ref = read(updated)
+	if ok, err := c.SetIfNewer(updated, testValue(updated, 50), 1); !ok || err != nil {
+		t.Fatalf("SetIfNewer: %v, %v", ok, err)
+	}
+	b.SetFromDisk(updated, h, e, ref)
+	if _, version, ok := c.GetWithVersion(nil, updated); !ok || version != 1 {
+		t.Fatalf("key %q version %d, %v after SetIfNewer with version 1", updated, version, ok)
+	}
+
+	// Без конкурентных изменений запись возвращается в память.
+	kept := spilled[2]
+	b, h, e, ref = read(kept)
+	b.SetFromDisk(kept, h, e, ref)
+	if v, ok := c.peek(nil, kept); !ok || !isTestValue(kept, v) {
+		t.Fatalf("key %q not moved to memory: %q, %v", kept, v, ok)
+	}
+}
@@ -0,0 +1,271 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// snapshotMagic открывает каждый файл снапшота кеша.
+var snapshotMagic = [8]byte{'0', 'l', 'v', 'l', 'c', 'a', 'c', 'h'}
+
+// snapshotVersion версия формата снапшота.
+// Увеличивается при любом изменении раскладки bucket или формата записи в chunks.
+const snapshotVersion = 4
+
+// ErrSnapshotCorrupted возвращается LoadFromFile, если контрольная сумма
+// или структура снапшота не сходятся.
+var ErrSnapshotCorrupted = errors.New("cache snapshot is corrupted")
+
+// SaveToFile сохраняет содержимое кеша в файл path.
+//
+// Файл сначала пишется во временный файл рядом с path и затем атомарно
+// переименовывается, поэтому при падении процесса старый снапшот не портится.
+// Каждый bucket сохраняется под своей блокировкой на чтение, так что SaveToFile
+// можно вызывать параллельно с Set/Get.
+func (c *Cache) SaveToFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*"); if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	err = c.writeSnapshot(tmp); if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync(); if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close(); if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadFromFile загружает кеш, сохраненный SaveToFile.
+//
+// Число bucket и размер chunk должны совпадать с сохраненным кешем,
+// а chunks в bucket должно быть не больше, чем у нового кеша.
+// При отсутствии файла возвращается ошибка, для которой os.IsNotExist == true,
+// при несовпадении контрольной суммы, версии или геометрии — ErrSnapshotCorrupted.
+// В обоих случаях вызывающий должен создать пустой кеш через New.
+func LoadFromFile(path string, maxBytes uint64) (*Cache, error) {
+	return LoadFromFileWithOptions(path, Options{MaxBytes: maxBytes})
+}
+
+// LoadFromFileWithOptions работает как LoadFromFile для кеша, созданного NewWithOptions.
+// Политика допуска и вытеснения может отличаться от сохраненной, статистика sketch не сохраняется.
+func LoadFromFileWithOptions(path string, opts Options) (*Cache, error) {
+	f, err := os.Open(path); if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := NewWithOptions(opts); if err != nil {
+		return nil, err
+	}
+	err = c.readSnapshot(f); if err != nil {
+		// Reset очистил бы и второй уровень на диске, который от снапшота не зависит.
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cache) writeSnapshot(f io.Writer) error {
+	w := bufio.NewWriterSize(f, 1024*1024)
+	digest := xxhash.New()
+	sw := &snapshotWriter{w: io.MultiWriter(w, digest)}
+
+	sw.write(snapshotMagic[:])
+	sw.uint64(snapshotVersion)
+	sw.uint64(uint64(len(c.buckets)))
+	sw.uint64(c.chunkSize)
+	for i := range c.buckets {
+		c.buckets[i].writeSnapshot(sw)
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], digest.Sum64())
+	_, err := w.Write(sum[:]); if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (c *Cache) readSnapshot(f io.Reader) error {
+	r := bufio.NewReaderSize(f, 1024*1024)
+	digest := xxhash.New()
+	sr := &snapshotReader{r: io.TeeReader(r, digest)}
+
+	var magic [8]byte
+	sr.read(magic[:])
+	version := sr.uint64()
+	buckets := sr.uint64()
+	chunk := sr.uint64()
+	if sr.err != nil {
+		return sr.err
+	}
+	if magic != snapshotMagic {
+		return fmt.Errorf("%w: bad magic", ErrSnapshotCorrupted)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d; want %d", ErrSnapshotCorrupted, version, snapshotVersion)
+	}
+	if buckets != uint64(len(c.buckets)) || chunk != c.chunkSize {
+		return fmt.Errorf("%w: geometry buckets=%d chunk=%d; want buckets=%d chunk=%d",
+			ErrSnapshotCorrupted, buckets, chunk, len(c.buckets), c.chunkSize)
+	}
+
+	for i := range c.buckets {
+		err := c.buckets[i].readSnapshot(sr); if err != nil {
+			return err
+		}
+	}
+
+	// Контрольная сумма читается мимо digest.
+	var sum [8]byte
+	_, err := io.ReadFull(r, sum[:]); if err != nil {
+		return fmt.Errorf("%w: %s", ErrSnapshotCorrupted, err)
+	}
+	if binary.LittleEndian.Uint64(sum[:]) != digest.Sum64() {
+		return fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+	return nil
+}
+
+func (b *bucket) writeSnapshot(sw *snapshotWriter) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	sw.uint64(b.idx)
+	sw.uint64(b.gen)
+	sw.uint64(uint64(len(b.chunks)))
+	sw.uint64(uint64(len(b.m)))
+	for k, v := range b.m {
+		sw.uint64(k)
+		sw.uint64(v)
+	}
+	for _, chunk := range b.chunks {
+		sw.uint64(uint64(len(chunk)))
+		sw.write(chunk)
+	}
+}
+
+func (b *bucket) readSnapshot(sr *snapshotReader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := sr.uint64()
+	gen := sr.uint64()
+	chunksLen := sr.uint64()
+	mLen := sr.uint64()
+	if sr.err != nil {
+		return sr.err
+	}
+	// Заголовок проверяется по контрольной сумме только в конце файла,
+	// поэтому размеры из него ограничиваются емкостью bucket, а не доверяются.
+	// Пространства имен создаются после загрузки, так что сейчас bucket
+	// полной длины; сохраненный мог быть короче на вырезанную квоту.
+	maxChunks := uint64(len(b.chunks))
+	if chunksLen == 0 || chunksLen > maxChunks {
+		return fmt.Errorf("%w: bucket has %d chunks; want at most %d", ErrSnapshotCorrupted, chunksLen, maxChunks)
+	}
+	if idx > chunksLen*b.chunkSize || gen == 0 || gen > maxGen {
+		return fmt.Errorf("%w: bad bucket position idx=%d gen=%d", ErrSnapshotCorrupted, idx, gen)
+	}
+	if mLen > chunksLen*b.chunkSize/entryHeaderSize {
+		return fmt.Errorf("%w: too many entries %d", ErrSnapshotCorrupted, mLen)
+	}
+
+	m := make(map[uint64]uint64)
+	for i := uint64(0); i < mLen && sr.err == nil; i++ {
+		k := sr.uint64()
+		m[k] = sr.uint64()
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	// Bucket читается в сохраненной длине и затем приводится к текущей.
+	b.resizeLocked(chunksLen)
+	for i := range b.chunks {
+		n := sr.uint64()
+		if sr.err != nil {
+			return sr.err
+		}
+		if n > b.chunkSize {
+			return fmt.Errorf("%w: chunk length %d", ErrSnapshotCorrupted, n)
+		}
+		if n == 0 {
+			continue
+		}
+		chunk := b.alloc.Get()
+		chunk = chunk[:n]
+		sr.read(chunk)
+		b.chunks[i] = chunk
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+
+	b.m = m
+	b.idx = idx
+	b.gen = gen
+	b.resizeLocked(maxChunks)
+	return nil
+}
+
+// snapshotWriter запоминает первую ошибку записи, чтобы не проверять ее после каждого поля.
+type snapshotWriter struct {
+	w   io.Writer
+	buf [8]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(p)
+}
+
+func (sw *snapshotWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(sw.buf[:], v)
+	sw.write(sw.buf[:])
+}
+
+// snapshotReader запоминает первую ошибку чтения; неожиданный конец файла
+// считается повреждением снапшота.
+type snapshotReader struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func (sr *snapshotReader) read(p []byte) {
+	if sr.err != nil {
+		return
+	}
+	_, err := io.ReadFull(sr.r, p); if err != nil {
+		sr.err = fmt.Errorf("%w: %s", ErrSnapshotCorrupted, err)
+	}
+}
+
+func (sr *snapshotReader) uint64() uint64 {
+	sr.read(sr.buf[:])
+	if sr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(sr.buf[:])
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzSetGet проверяет Set/Get для произвольных длин ключа и значения,
+// в том числе около границы chunk, где значение начинает храниться по частям.
+func FuzzSetGet(f *testing.F) {
+	const chunk = defaultChunkSize
+	for _, n := range []uint32{0, 1, chunk - entryHeaderSize - 2, chunk - entryHeaderSize - 1, chunk - entryHeaderSize,
+		chunk - 1, chunk, chunk + 1, 2*chunk - 1, 2 * chunk, 3*chunk + 7} {
+		f.Add([]byte("k"), n, byte(1))
+	}
+	f.Add(bytes.Repeat([]byte("k"), chunk-entryHeaderSize-bigSubkeyLen-1), uint32(10), byte(2))
+	f.Add(bytes.Repeat([]byte("k"), chunk-entryHeaderSize-bigSubkeyLen), uint32(10), byte(3))
+	f.Add(bytes.Repeat([]byte("k"), chunk), uint32(10), byte(4))
+
+	c, err := NewWithOptions(Options{MaxBytes: 256 * 1024 * 1024})
+	if err != nil {
+		f.Fatalf("NewWithOptions: %s", err)
+	}
+	defer c.Close()
+
+	f.Fuzz(func(t *testing.T, k []byte, n uint32, seed byte) {
+		n %= 4 * chunk
+		v := make([]byte, n)
+		for i := range v {
+			v[i] = seed + byte(i>>7)
+		}
+
+		err := c.Set(k, v)
+		if len(k) > c.maxKeyLen() {
+			if err == nil {
+				t.Fatalf("Set with %d byte key succeeded", len(k))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Set(%d byte key, %d byte value): %s", len(k), n, err)
+		}
+		got, ok := c.HasGet(nil, k)
+		if !ok || !bytes.Equal(got, v) {
+			t.Fatalf("HasGet(%d byte key) = %d bytes, %v; want %d bytes", len(k), len(got), ok, n)
+		}
+		if !c.Del(k) || c.Has(k) {
+			t.Fatalf("Del(%d byte key) did not remove it", len(k))
+		}
+	})
+}
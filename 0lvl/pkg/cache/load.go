@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader загружает значение для ключа k, которого нет в кеше,
+// и возвращает срок жизни, с которым его сохранить (0 — без срока).
+type Loader func(k []byte) (v []byte, ttl time.Duration, err error)
+
+// ErrLoaderPanic получают конкурентные вызовы GetOrLoad, если loader,
+// вызванный для них другим вызовом, запаниковал.
+var ErrLoaderPanic = errors.New("cache loader panicked")
+
+// loadCall — загрузка, которую ждут все конкурентные промахи по одному ключу.
+type loadCall struct {
+	wg  sync.WaitGroup
+	v   []byte
+	err error
+}
+
+// loadGroup схлопывает конкурентные вызовы Loader для одного ключа в один.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+
+	loads  uint64
+	shared uint64
+}
+
+// GetOrLoad добавляет значение по ключу k в dst.
+//
+// При промахе вызывается loader, и его результат сохраняется в кеш.
+// Конкурентные промахи по одному ключу ждут один общий вызов loader
+// и получают его результат, в том числе ошибку. Ошибки loader не кешируются.
+func (c *Cache) GetOrLoad(dst, k []byte, loader Loader) ([]byte, error) {
+	dstLen := len(dst)
+	dst, ok := c.HasGet(dst, k)
+	if ok {
+		return dst, nil
+	}
+
+	lc, leader := c.loads.start(k)
+	if !leader {
+		atomic.AddUint64(&c.loads.shared, 1)
+		lc.wg.Wait()
+		if lc.err != nil {
+			return dst[:dstLen], lc.err
+		}
+		return append(dst[:dstLen], lc.v...), nil
+	}
+	defer c.loads.finish(k, lc)
+
+	// Предыдущая загрузка могла завершиться между HasGet и start.
+	dst, ok = c.HasGet(dst[:dstLen], k)
+	if ok {
+		lc.v = append([]byte(nil), dst[dstLen:]...)
+		return dst, nil
+	}
+
+	atomic.AddUint64(&c.loads.loads, 1)
+	var ttl time.Duration
+	// Если loader запаникует, finish отпустит ждущих с этой ошибкой,
+	// а не с пустым значением как с успехом.
+	lc.err = ErrLoaderPanic
+	lc.v, ttl, lc.err = loader(k)
+	if lc.err != nil {
+		return dst[:dstLen], lc.err
+	}
+	// Значение, которое не удалось сохранить, все равно отдаем вызывающим.
+	_ = c.SetWithTTL(k, lc.v, ttl)
+	return append(dst[:dstLen], lc.v...), nil
+}
+
+// start регистрирует загрузку ключа k. Если загрузка уже идет,
+// возвращает ее и false.
+func (g *loadGroup) start(k []byte) (*loadCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if lc, ok := g.calls[string(k)]; ok {
+		return lc, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	lc := &loadCall{}
+	lc.wg.Add(1)
+	g.calls[string(k)] = lc
+	return lc, true
+}
+
+func (g *loadGroup) finish(k []byte, lc *loadCall) {
+	g.mu.Lock()
+	delete(g.calls, string(k))
+	g.mu.Unlock()
+	lc.wg.Done()
+}
@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNamespaceQuota возвращается Namespace, если у кеша не хватает chunks на квоту.
+var ErrNamespaceQuota = errors.New("cache has not enough capacity for namespace quota")
+
+// Namespace — часть кеша с собственными bucket, статистикой и квотой памяти.
+//
+// Записи пространства имен хранятся отдельно от записей родительского кеша
+// и других пространств имен, поэтому они не вытесняют друг друга и ключи
+// разных пространств имен не пересекаются. Квота вырезается из емкости
+// родителя: его кольцевые буферы укорачиваются на столько же chunks.
+//
+// Пространства имен не попадают в снапшот SaveToFile родителя
+// и не используют второй уровень на диске.
+type Namespace struct {
+	*Cache
+
+	name   string
+	parent *Cache
+
+	// carved сколько chunks забрано у каждого bucket родителя.
+	carved []uint64
+}
+
+// namespaces — пространства имен кеша по именам.
+type namespaces struct {
+	mu     sync.Mutex
+	byName map[string]*Namespace
+
+	// cursor — bucket родителя, с которого начнется вырезание следующей квоты,
+	// чтобы квоты разных пространств имен забирали chunks у разных bucket.
+	cursor int
+}
+
+// Namespace возвращает пространство имен name с квотой maxBytes,
+// создавая его при первом вызове.
+//
+// Пространство имен использует ChunkSize, политику и кодек родителя,
+// а bucket в нем столько, сколько chunks влезает в квоту, но не больше,
+// чем у родителя. В каждом bucket родителя должен остаться хотя бы один chunk,
+// иначе возвращается ErrNamespaceQuota.
+func (c *Cache) Namespace(name string, maxBytes uint64) (*Namespace, error) {
+	c.namespaces.mu.Lock()
+	defer c.namespaces.mu.Unlock()
+
+	if ns, ok := c.namespaces.byName[name]; ok {
+		if ns.opts.MaxBytes != maxBytes {
+			return nil, fmt.Errorf("namespace %q already exists with quota %d", name, ns.opts.MaxBytes)
+		}
+		return ns, nil
+	}
+	if maxBytes == 0 {
+		return nil, fmt.Errorf("namespace quota must be greater than 0")
+	}
+
+	opts := c.opts
+	opts.MaxBytes = maxBytes
+	opts.DiskPath = ""
+	opts.BucketsCount = (maxBytes + c.chunkSize - 1) / c.chunkSize
+	if opts.BucketsCount > uint64(len(c.buckets)) {
+		opts.BucketsCount = uint64(len(c.buckets))
+	}
+	child, err := newCache(opts, c.alloc); if err != nil {
+		return nil, err
+	}
+	var need uint64
+	for i := range child.buckets {
+		need += uint64(len(child.buckets[i].chunks))
+	}
+
+	carved, err := c.carve(need); if err != nil {
+		return nil, err
+	}
+	ns := &Namespace{
+		Cache:  child,
+		name:   name,
+		parent: c,
+		carved: carved,
+	}
+	if c.namespaces.byName == nil {
+		c.namespaces.byName = make(map[string]*Namespace)
+	}
+	c.namespaces.byName[name] = ns
+	return ns, nil
+}
+
+// Name возвращает имя пространства имен.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Close освобождает память пространства имен и возвращает квоту родителю.
+// После Close пространство имен нельзя использовать,
+// а Namespace с тем же именем создаст новое.
+func (ns *Namespace) Close() error {
+	p := ns.parent
+	p.namespaces.mu.Lock()
+	defer p.namespaces.mu.Unlock()
+	if p.namespaces.byName[ns.name] != ns {
+		return nil
+	}
+	delete(p.namespaces.byName, ns.name)
+
+	for i := range ns.buckets {
+		ns.buckets[i].Reset()
+	}
+	for i, n := range ns.carved {
+		if n > 0 {
+			b := &p.buckets[i]
+			b.Resize(b.chunksCount() + n)
+		}
+	}
+	return p.alloc.Trim()
+}
+
+// closeNamespaces закрывает все пространства имен кеша.
+func (c *Cache) closeNamespaces() {
+	c.namespaces.mu.Lock()
+	all := make([]*Namespace, 0, len(c.namespaces.byName))
+	for _, ns := range c.namespaces.byName {
+		all = append(all, ns)
+	}
+	c.namespaces.mu.Unlock()
+
+	for _, ns := range all {
+		_ = ns.Close()
+	}
+}
+
+// carve забирает need chunks у bucket кеша по одному по кругу,
+// оставляя каждому хотя бы один chunk. Возвращает, сколько забрано у каждого bucket.
+// Вызывающий держит c.namespaces.mu.
+func (c *Cache) carve(need uint64) ([]uint64, error) {
+	counts := make([]uint64, len(c.buckets))
+	for i := range c.buckets {
+		counts[i] = c.buckets[i].chunksCount()
+	}
+	carved := make([]uint64, len(c.buckets))
+	j := c.namespaces.cursor
+	idle := 0
+	for need > 0 {
+		if idle == len(c.buckets) {
+			return nil, fmt.Errorf("%w: %d chunks more needed", ErrNamespaceQuota, need)
+		}
+		if counts[j]-carved[j] > 1 {
+			carved[j]++
+			need--
+			idle = 0
+		} else {
+			idle++
+		}
+		j = (j + 1) % len(c.buckets)
+	}
+	c.namespaces.cursor = j
+
+	for i, n := range carved {
+		if n > 0 {
+			c.buckets[i].Resize(counts[i] - n)
+		}
+	}
+	return carved, nil
+}
+
+func (b *bucket) chunksCount() uint64 {
+	b.mu.RLock()
+	n := uint64(len(b.chunks))
+	b.mu.RUnlock()
+	return n
+}
+
+// Resize меняет длину кольцевого буфера bucket на maxChunks chunks.
+//
+// При удлинении новые chunks добавляются в конец буфера и заполнятся,
+// когда до них дойдет запись. При укорочении записи из отрезанных chunks
+// удаляются, а если голова буфера оказалась за новым концом,
+// буфер начинается сначала, как при переполнении.
+func (b *bucket) Resize(maxChunks uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resizeLocked(maxChunks)
+}
+
+func (b *bucket) resizeLocked(maxChunks uint64) {
+	n := uint64(len(b.chunks))
+	if maxChunks >= n {
+		for ; n < maxChunks; n++ {
+			b.chunks = append(b.chunks, nil)
+		}
+		return
+	}
+
+	for i := maxChunks; i < n; i++ {
+		b.alloc.Put(b.chunks[i])
+		b.chunks[i] = nil
+	}
+	b.chunks = b.chunks[:maxChunks]
+	limit := maxChunks * b.chunkSize
+	for h, v := range b.m {
+		if v&((1<<bucketSizeBits)-1) >= limit {
+			delete(b.m, h)
+		}
+	}
+	if b.idx >= limit {
+		b.idx = 0
+		b.gen++
+		if b.gen&((1<<genSizeBits)-1) == 0 {
+			b.gen++
+		}
+		b.genWraps++
+		b.cleanTimedLocked()
+	}
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sketchDepth количество строк count-min sketch.
+const sketchDepth = 4
+
+// sketchEntryBytes примерный размер записи, по которому считается ширина sketch.
+const sketchEntryBytes = 256
+
+// sketchSeeds перемешивают хеш ключа для каждой строки sketch.
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+// frequencySketch — count-min sketch с насыщающимися 8-битными счетчиками.
+//
+// Когда число добавлений достигает resetAt, все счетчики делятся пополам,
+// так что старая популярность со временем забывается.
+type frequencySketch struct {
+	mu        sync.Mutex
+	table     []uint8
+	width     uint64
+	additions uint64
+	resetAt   uint64
+}
+
+// newFrequencySketch создает sketch для bucket емкостью maxBytes.
+func newFrequencySketch(maxBytes uint64) *frequencySketch {
+	width := uint64(64)
+	for width*sketchEntryBytes < maxBytes && width < 1<<16 {
+		width <<= 1
+	}
+	return &frequencySketch{
+		table:   make([]uint8, sketchDepth*width),
+		width:   width,
+		resetAt: 10 * width,
+	}
+}
+
+func (s *frequencySketch) index(h uint64, row int) uint64 {
+	x := (h ^ sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	return uint64(row)*s.width + (x>>32)&(s.width-1)
+}
+
+// Add учитывает обращение к ключу с хешем h.
+func (s *frequencySketch) Add(h uint64) {
+	s.mu.Lock()
+	for row := 0; row < sketchDepth; row++ {
+		i := s.index(h, row)
+		if s.table[i] < 255 {
+			s.table[i]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.table {
+			s.table[i] >>= 1
+		}
+		s.additions /= 2
+	}
+	s.mu.Unlock()
+}
+
+// Estimate возвращает оценку сверху количества обращений к ключу с хешем h.
+func (s *frequencySketch) Estimate(h uint64) uint8 {
+	s.mu.Lock()
+	est := uint8(255)
+	for row := 0; row < sketchDepth; row++ {
+		if c := s.table[s.index(h, row)]; c < est {
+			est = c
+		}
+	}
+	s.mu.Unlock()
+	return est
+}
+
+func (s *frequencySketch) Reset() {
+	s.mu.Lock()
+	for i := range s.table {
+		s.table[i] = 0
+	}
+	s.additions = 0
+	s.mu.Unlock()
+}
+
+// Admit решает, записывать ли ключ с хешем h в bucket, и учитывает обращение к нему.
+//
+// Пока bucket ни разу не заполнился, или ключ уже есть в нем, запись допускается
+// всегда. Иначе ключ должен набрать в sketch не меньше admitMinFrequency обращений.
+func (b *bucket) Admit(h uint64) bool {
+	if b.sketch == nil || b.frequent(h) {
+		return true
+	}
+	b.mu.RLock()
+	ok := b.admitLocked(h)
+	b.mu.RUnlock()
+	return ok
+}
+
+// frequent учитывает обращение к ключу h и сообщает, набрал ли он
+// до этого admitMinFrequency обращений.
+func (b *bucket) frequent(h uint64) bool {
+	est := b.sketch.Estimate(h)
+	b.sketch.Add(h)
+	return est >= b.admitMinFrequency
+}
+
+// admitLocked решает, записывать ли редкий ключ h. Вызывающий держит b.mu.
+func (b *bucket) admitLocked(h uint64) bool {
+	_, present := b.findLocked(h)
+	if b.gen <= 1 || present {
+		return true
+	}
+	atomic.AddUint64(&b.admissionRejects, 1)
+	return false
+}
+
+// isOldLocked возвращает true, если запись v из b.m лежит в предыдущем
+// поколении, то есть будет перезаписана раньше всех записей текущего.
+func (b *bucket) isOldLocked(v uint64) bool {
+	if v == 0 {
+		return false
+	}
+	bGen := b.gen & ((1 << genSizeBits) - 1)
+	return v>>bucketSizeBits != bGen
+}
+
+// Promote переписывает запись k из предыдущего поколения в голову кольцевого буфера.
+func (b *bucket) Promote(k []byte, h uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Запись могли уже продвинуть или перезаписать, пока мы ждали блокировку.
+	v := b.m[h]
+	if !b.isOldLocked(v) {
+		return
+	}
+	e, ok := b.entryAtLocked(v)
+	if !ok || string(e.key) != string(k) {
+		return
+	}
+	// Запись в голову может затереть chunk со старой записью, поэтому значение копируется.
+	value := append([]byte(nil), e.value...)
+	b.setLocked(k, value, h, e.flags, e.expireAt, e.version)
+	atomic.AddUint64(&b.promotions, 1)
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess гоняет операции кеша и его пространства имен из нескольких горутин.
+// Запускать с -race. Значение всегда начинается с ключа, поэтому чужое
+// или порванное значение обнаруживается.
+func TestConcurrentAccess(t *testing.T) {
+	c := newTestCache(t, Options{MaxBytes: 1024 * 1024, BucketsCount: 16, ChunkSize: 4096, PromoteOnHit: true, AdmitMinFrequency: 1})
+	ns, err := c.Namespace("ns", 64*1024)
+	if err != nil {
+		t.Fatalf("Namespace: %s", err)
+	}
+
+	iterations := 20000
+	if testing.Short() {
+		iterations = 2000
+	}
+	path := t.TempDir() + "/cache.snapshot"
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				k := []byte(fmt.Sprintf("key %d", (i*7+g)%1000))
+				target := c
+				if i%5 == 0 {
+					target = ns.Cache
+				}
+				switch i % 10 {
+				case 0, 1, 2:
+					_ = target.Set(k, testValue(k, i%3000))
+				case 3:
+					_, _ = target.SetIfNewer(k, testValue(k, 100), uint64(i))
+				case 4:
+					target.Del(k)
+				case 5:
+					target.Has(k)
+				default:
+					v, ok := target.HasGet(nil, k)
+					if ok && !isTestValue(k, v) {
+						t.Errorf("HasGet(%q) returned foreign value", k)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			c.Visit(func(k, v []byte) bool {
+				if !isTestValue(k, v) {
+					t.Errorf("Visit(%q) returned foreign value", k)
+					return false
+				}
+				return true
+			})
+			var s DetailedStats
+			c.UpdateDetailedStats(&s, 10)
+			if i%5 == 0 {
+				if err := c.SaveToFile(path); err != nil {
+					t.Errorf("SaveToFile: %s", err)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	var s Stats
+	c.UpdateStats(&s)
+	if s.Сorruptions != 0 {
+		t.Fatalf("%d corruptions", s.Сorruptions)
+	}
+}
+
+// TestConcurrentDiskAccess проверяет, что Get, поднимающий запись с диска,
+// не воскрешает ключ, удаленный конкурентным Del, и не затирает новую версию
+// конкурентного SetIfNewer. Запускать с -race.
+func TestConcurrentDiskAccess(t *testing.T) {
+	c := newTestCache(t, diskTestOptions(t.TempDir()))
+	rounds := 20
+	if testing.Short() {
+		rounds = 4
+	}
+	for round := 0; round < rounds; round++ {
+		spilled := setDiskTestKeys(t, c, 500)
+		// Из файла запись читается дольше, чем из буфера записи.
+		c.disk.flush()
+		// Горутины стартуют разом, чтобы чтение диска пересекалось с Del и SetIfNewer.
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, k := range spilled {
+			k := k
+			for r := 0; r < 4; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					v, ok := c.HasGet(nil, k)
+					if ok && !isTestValue(k, v) {
+						t.Errorf("HasGet(%q) returned foreign value", k)
+					}
+				}()
+			}
+			wg.Add(1)
+			if i%2 == 0 {
+				go func() {
+					defer wg.Done()
+					<-start
+					c.Del(k)
+				}()
+			} else {
+				go func() {
+					defer wg.Done()
+					<-start
+					_, _ = c.SetIfNewer(k, testValue(k, 50), 1)
+				}()
+			}
+		}
+		close(start)
+		wg.Wait()
+
+		for i, k := range spilled {
+			if i%2 == 0 {
+				if c.Has(k) {
+					t.Fatalf("round %d: deleted key %q came back from disk", round, k)
+				}
+				continue
+			}
+			v, version, ok := c.GetWithVersion(nil, k)
+			if ok && (version != 1 || len(v) != len(testValue(k, 50))) {
+				t.Fatalf("round %d: key %q has version %d after SetIfNewer with version 1", round, k, version)
+			}
+		}
+	}
+}
+
+// isTestValue проверяет, что v построено testValue для ключа k.
+// k может ссылаться на память chunk, поэтому к нему нельзя делать append.
+func isTestValue(k, v []byte) bool {
+	return len(v) > len(k) && bytes.HasPrefix(v, k) && v[len(k)] == ':'
+}
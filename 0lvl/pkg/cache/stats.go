@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hotKeysCapacity сколько ключей одновременно отслеживает сэмплер горячих ключей.
+const hotKeysCapacity = 256
+
+// DetailedStats — подробная статистика кеша, см. Cache.UpdateDetailedStats.
+type DetailedStats struct {
+	Stats
+
+	// Buckets — статистика каждого bucket в порядке их индексов.
+	Buckets []BucketStats
+
+	// EntriesMin и EntriesMax — минимальное и максимальное количество записей
+	// в bucket. Большой разброс означает перекос распределения хешей.
+	EntriesMin uint64
+	EntriesMax uint64
+
+	// HotKeys — самые частые ключи среди сэмплированных Get,
+	// по убыванию частоты. Пусто, если Options.HotKeysSampleRate не задан.
+	HotKeys []HotKey
+}
+
+// BucketStats — статистика одного bucket.
+type BucketStats struct {
+	EntriesCount uint64
+
+	// WrittenBytes — сколько байт кольцевого буфера занято записями.
+	// После первого переполнения буфер занят целиком.
+	WrittenBytes uint64
+	MaxBytes     uint64
+
+	// Fill — WrittenBytes / MaxBytes.
+	Fill float64
+
+	// GenWraps — сколько раз кольцевой буфер начинался сначала.
+	GenWraps uint64
+
+	// CleanDuration и CleanMaxDuration — суммарное и максимальное время
+	// очистки индекса после переполнения буфера. Все это время bucket
+	// заблокирован на запись.
+	CleanDuration    time.Duration
+	CleanMaxDuration time.Duration
+}
+
+// HotKey — ключ и количество сэмплированных обращений к нему.
+type HotKey struct {
+	Key  string
+	Hits uint64
+}
+
+// UpdateDetailedStats заполняет s подробной статистикой кеша
+// с не более чем topN горячими ключами.
+//
+// В отличие от UpdateStats, s перезаписывается, а не дополняется.
+func (c *Cache) UpdateDetailedStats(s *DetailedStats, topN int) {
+	*s = DetailedStats{}
+	c.UpdateStats(&s.Stats)
+
+	s.Buckets = make([]BucketStats, len(c.buckets))
+	for i := range c.buckets {
+		bs := &s.Buckets[i]
+		c.buckets[i].UpdateBucketStats(bs)
+		if i == 0 || bs.EntriesCount < s.EntriesMin {
+			s.EntriesMin = bs.EntriesCount
+		}
+		if bs.EntriesCount > s.EntriesMax {
+			s.EntriesMax = bs.EntriesCount
+		}
+	}
+	if c.hotKeys != nil {
+		s.HotKeys = c.hotKeys.Top(topN)
+	}
+}
+
+func (b *bucket) UpdateBucketStats(s *BucketStats) {
+	b.mu.RLock()
+	s.EntriesCount = uint64(len(b.m))
+	s.MaxBytes = uint64(len(b.chunks)) * b.chunkSize
+	s.WrittenBytes = b.idx
+	if b.gen > 1 {
+		s.WrittenBytes = s.MaxBytes
+	}
+	s.GenWraps = b.genWraps
+	s.CleanDuration = time.Duration(b.cleanNanos)
+	s.CleanMaxDuration = time.Duration(b.cleanMaxNanos)
+	b.mu.RUnlock()
+
+	if s.MaxBytes > 0 {
+		s.Fill = float64(s.WrittenBytes) / float64(s.MaxBytes)
+	}
+}
+
+// cleanTimedLocked вызывает cleanLocked и учитывает его длительность.
+func (b *bucket) cleanTimedLocked() {
+	start := time.Now()
+	b.cleanLocked()
+	d := uint64(time.Since(start))
+	b.cleanNanos += d
+	if d > b.cleanMaxNanos {
+		b.cleanMaxNanos = d
+	}
+}
+
+// hotKeySampler считает частоту ключей каждого rate-го Get алгоритмом
+// Space-Saving: при переполнении вытесняется ключ с наименьшим счетчиком,
+// а новый ключ наследует его счетчик.
+type hotKeySampler struct {
+	rate  uint64
+	calls uint64
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newHotKeySampler(rate uint64) *hotKeySampler {
+	return &hotKeySampler{
+		rate:   rate,
+		counts: make(map[string]uint64, hotKeysCapacity),
+	}
+}
+
+// Sample учитывает обращение к k, если оно попало в выборку.
+func (s *hotKeySampler) Sample(k []byte) {
+	if atomic.AddUint64(&s.calls, 1)%s.rate != 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.counts[string(k)]; ok {
+		s.counts[string(k)] = n + 1
+		return
+	}
+	var inherited uint64
+	if len(s.counts) >= hotKeysCapacity {
+		minKey := ""
+		minCount := ^uint64(0)
+		for key, n := range s.counts {
+			if n < minCount {
+				minKey, minCount = key, n
+			}
+		}
+		delete(s.counts, minKey)
+		inherited = minCount
+	}
+	s.counts[string(k)] = inherited + 1
+}
+
+// Top возвращает не более n самых частых ключей.
+func (s *hotKeySampler) Top(n int) []HotKey {
+	s.mu.Lock()
+	top := make([]HotKey, 0, len(s.counts))
+	for key, hits := range s.counts {
+		top = append(top, HotKey{Key: key, Hits: hits})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Hits > top[j].Hits
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (s *hotKeySampler) Reset() {
+	s.mu.Lock()
+	s.counts = make(map[string]uint64, hotKeysCapacity)
+	s.mu.Unlock()
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+
+	xxhash "github.com/cespare/xxhash/v2"
+)
+
+// SetIfNewer сохраняет значение v по ключу k с версией version,
+// если в кеше нет живой записи k с той же или более новой версией.
+// Возвращает, было ли значение записано.
+//
+// Записи, сохраненные через Set, имеют версию 0 и заменяются любой версией больше 0.
+// Проверка версии и запись выполняются под одной блокировкой bucket,
+// поэтому медленный писатель со старой версией не затрет новую.
+//
+// Допуск по частоте применяется, как в Set, только к ключам, которых нет в кеше:
+// новая версия закешированного ключа записывается всегда, иначе в кеше осталась бы старая.
+// Ключ, не прошедший допуск, не записывается, и SetIfNewer возвращает false.
+func (c *Cache) SetIfNewer(k, v []byte, version uint64) (bool, error) {
+	return c.SetIfNewerWithTTL(k, v, version, 0)
+}
+
+// SetIfNewerWithTTL работает как SetIfNewer, но запись истекает через ttl, см. SetWithTTL.
+// Истекшая запись не мешает записи любой версии.
+func (c *Cache) SetIfNewerWithTTL(k, v []byte, version uint64, ttl time.Duration) (bool, error) {
+	if len(k) > c.maxKeyLen() {
+		return false, fmt.Errorf("key too long: %d; max %d", len(k), c.maxKeyLen())
+	}
+	var expireAt uint64
+	if ttl > 0 {
+		expireAt = uint64(time.Now().Add(ttl).UnixNano())
+	}
+	v, flags := c.compress(v)
+	if uint64(entryHeaderSize+len(k)+len(v)) >= c.chunkSize {
+		// Части пишутся заранее и не видны без мета-записи,
+		// а версия сверяется только при записи меты.
+		meta, err := c.setBigParts(v); if err != nil {
+			return false, err
+		}
+		v = meta[:]
+		flags |= flagBigMeta
+	}
+	h := xxhash.Sum64(k)
+	return c.bucket(h).SetIfNewer(k, v, h, flags, expireAt, version)
+}
+
+// GetWithVersion работает как HasGet и дополнительно возвращает версию значения,
+// с которой оно было сохранено SetIfNewer (0 для Set).
+func (c *Cache) GetWithVersion(dst, k []byte) ([]byte, uint64, bool) {
+	return c.get(dst, k)
+}
@@ -82,6 +82,7 @@ func genOrder() Order {
 	customerId := nonceGenerate(16)
 	orderUid := orderId + customerId
 
+	goodsTotal := 0
 	for i := 0; i < 2; i++ {
 		item := Item{
 			ChrtId:      fake.Number(1, 9999999),
@@ -97,6 +98,7 @@ func genOrder() Order {
 			Status:      0,
 		}
 		items = append(items, item)
+		goodsTotal += item.TotalPrice
 	}
 
 	order := Order{
@@ -117,11 +119,11 @@ func genOrder() Order {
 			RequestId:    "",
 			Currency:     fake.CurrencyShort(),
 			Provider:     "wbpay",
-			Amount:       3000,
+			Amount:       goodsTotal + 2403,
 			PaymentDt:    0,
 			Bank:         "SberBank",
 			DeliveryCost: 2403,
-			GoodsTotal:   597,
+			GoodsTotal:   goodsTotal,
 			CustomFee:    0,
 		},
 		Items:             items,
@@ -1,5 +1,6 @@
 DROP TABLE item;
 DROP TABLE trade;
+DROP TABLE trade_dead_letter;
 
 CREATE TABLE trade (
     pk        VARCHAR(32) PRIMARY KEY,
@@ -7,6 +8,16 @@ CREATE TABLE trade (
     entity    JSONB
 );
 
+CREATE TABLE trade_dead_letter (
+    id          BIGSERIAL PRIMARY KEY,
+    subject     TEXT,
+    sequence    BIGINT,
+    payload     BYTEA,
+    error       TEXT,
+    received_at TIMESTAMPTZ,
+    redriven_at TIMESTAMPTZ
+);
+
 CREATE TABLE trade (
     pk        VARCHAR(32) PRIMARY KEY,
     entry     VARCHAR(16)